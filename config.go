@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type xmlProperty struct {
@@ -16,16 +18,57 @@ type xmlProperty struct {
 	Value string `xml:",chardata"`
 }
 
+type xmlSampling struct {
+	Tick       string `xml:"tick,attr"`
+	First      string `xml:"first,attr"`
+	Thereafter string `xml:"thereafter,attr"`
+}
+
+type xmlMatchField struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlMatch struct {
+	MinLevel string          `xml:"minlevel"`
+	MaxLevel string          `xml:"maxlevel"`
+	Levels   string          `xml:"levels"`
+	Source   string          `xml:"source"`
+	Message  string          `xml:"message"`
+	Field    []xmlMatchField `xml:"field"`
+}
+
 type xmlFilter struct {
 	Enabled  string        `xml:"enabled,attr"`
 	Tag      string        `xml:"tag"`
 	Level    string        `xml:"level"`
 	Type     string        `xml:"type"`
 	Property []xmlProperty `xml:"property"`
+	Sampling *xmlSampling  `xml:"sampling"`
+	Match    []xmlMatch    `xml:"match"`
+}
+
+type xmlRedactKey struct {
+	Mode string `xml:"mode,attr"`
+	Glob string `xml:",chardata"`
+}
+
+type xmlRedactMessage struct {
+	Builtin string `xml:"builtin,attr"`
+	Replace string `xml:"replace,attr"`
+	Pattern string `xml:",chardata"`
+}
+
+type xmlRedact struct {
+	Placeholder string             `xml:"placeholder,attr"`
+	Keep        string             `xml:"keep,attr"`
+	Key         []xmlRedactKey     `xml:"key"`
+	Message     []xmlRedactMessage `xml:"message"`
 }
 
 type xmlLoggerConfig struct {
 	Filter []xmlFilter `xml:"filter"`
+	Redact *xmlRedact  `xml:"redact"`
 }
 
 // Load XML configuration; see examples/example.xml for documentation
@@ -51,9 +94,18 @@ func (log Logger) LoadConfiguration(filename string) {
 		os.Exit(1)
 	}
 
+	if xc.Redact != nil {
+		r, good := xmlToRedactor(filename, xc.Redact)
+		if !good {
+			os.Exit(1)
+		}
+		log.SetRedactor(r)
+	}
+
 	for _, xmlfilt := range xc.Filter {
 		var filt LogWriter
 		var lvl Level
+		var match Matcher
 		bad, good, enabled := false, true, false
 
 		// Check required children
@@ -76,24 +128,9 @@ func (log Logger) LoadConfiguration(filename string) {
 			bad = true
 		}
 
-		switch xmlfilt.Level {
-		case "FINEST":
-			lvl = FINEST
-		case "FINE":
-			lvl = FINE
-		case "DEBUG":
-			lvl = DEBUG
-		case "TRACE":
-			lvl = TRACE
-		case "INFO":
-			lvl = INFO
-		case "WARNING":
-			lvl = WARNING
-		case "ERROR":
-			lvl = ERROR
-		case "CRITICAL":
-			lvl = CRITICAL
-		default:
+		if l, ok := strToLevel(xmlfilt.Level); ok {
+			lvl = l
+		} else {
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter has unknown value in %s: %s\n", "level", filename, xmlfilt.Level)
 			bad = true
 		}
@@ -117,6 +154,18 @@ func (log Logger) LoadConfiguration(filename string) {
 			os.Exit(1)
 		}
 
+		if len(xmlfilt.Match) > 0 {
+			var matched bool
+			match, matched = xmlToMatcher(filename, xmlfilt.Match)
+			good = good && matched
+		}
+
+		if xmlfilt.Sampling != nil {
+			var sampled bool
+			filt, sampled = xmlToSamplingLogWriter(filename, xmlfilt.Sampling, filt, good && enabled)
+			good = good && sampled
+		}
+
 		// Just so all of the required params are errored at the same time if wrong
 		if !good {
 			os.Exit(1)
@@ -127,24 +176,57 @@ func (log Logger) LoadConfiguration(filename string) {
 			continue
 		}
 
-		log[xmlfilt.Tag] = &Filter{lvl, filt}
+		log.AddMatchFilter(xmlfilt.Tag, lvl, match, filt)
 	}
 }
 
 func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (*ConsoleLogWriter, bool) {
 
 	format := "[%D %T] [%L] (%S) %M"
+	encoder := ""
+	color := ColorAuto
+	colored := true
+	stderrLevel, leveled, routed := FINEST, true, false
+	var bufprops []xmlProperty
 
 	// Parse properties
 	for _, prop := range props {
 		switch prop.Name {
 		case "format":
 			format = strings.Trim(prop.Value, " \r\n")
+		case "buffersize", "overflow", "overflowtimeout", "overflowlevel":
+			bufprops = append(bufprops, prop)
+		case "encoder":
+			encoder = strings.Trim(prop.Value, " \r\n")
+		case "color":
+			value := strings.Trim(prop.Value, " \r\n")
+			colored = false
+			for m, name := range colorModeNames {
+				if value == name {
+					color, colored = ColorMode(m), true
+				}
+			}
+			if !colored {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid color \"%s\" in %s: want auto, always or never\n", value, filename)
+			}
+		case "stderrlevel":
+			value := strings.Trim(prop.Value, " \r\n")
+			stderrLevel, leveled = strToLevel(value)
+			routed = true
+			if !leveled {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid stderrlevel \"%s\" in %s\n", value, filename)
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for console filter in %s\n", prop.Name, filename)
 		}
 	}
 
+	size, overflow, good := xmlToOverflow(filename, bufprops)
+	enc, encoded := xmlToEncoder(filename, encoder, format)
+	if !good || !encoded || !colored || !leveled {
+		return nil, false
+	}
+
 	// If it's disabled, we're just checking syntax
 	if !enabled {
 		return nil, true
@@ -152,10 +234,31 @@ func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (
 
 	clw := NewConsoleLogWriter()
 	clw.SetFormat(format)
+	clw.SetColor(color)
+	if routed {
+		clw.SetStderrLevel(stderrLevel)
+	}
+	if size > 0 {
+		clw.SetBufferSize(size)
+	}
+	clw.SetOverflow(overflow)
+	if enc != nil {
+		clw.SetEncoder(enc)
+	}
 
 	return clw, true
 }
 
+// Parse a level name such as "WARNING"
+func strToLevel(str string) (Level, bool) {
+	for lvl, name := range levelNames {
+		if str == name {
+			return Level(lvl), true
+		}
+	}
+	return 0, false
+}
+
 // Parse a number with K/M/G suffixes based on thousands (1000) or 2^10 (1024)
 func strToNumSuffix(str string, mult int) int {
 	num := 1
@@ -182,6 +285,8 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 	maxsize := 0
 	daily := false
 	rotate := false
+	encoder := ""
+	var recprops, bufprops []xmlProperty
 
 	// Parse properties
 	for _, prop := range props {
@@ -198,6 +303,12 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 			daily = strings.Trim(prop.Value, " \r\n") != "false"
 		case "rotate":
 			rotate = strings.Trim(prop.Value, " \r\n") != "false"
+		case "recovery", "retries", "backoff":
+			recprops = append(recprops, prop)
+		case "buffersize", "overflow", "overflowtimeout", "overflowlevel":
+			bufprops = append(bufprops, prop)
+		case "encoder":
+			encoder = strings.Trim(prop.Value, " \r\n")
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
 		}
@@ -209,6 +320,13 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 		return nil, false
 	}
 
+	recovery, good := xmlToRecovery(filename, recprops)
+	size, overflow, sized := xmlToOverflow(filename, bufprops)
+	enc, encoded := xmlToEncoder(filename, encoder, format)
+	if !good || !sized || !encoded {
+		return nil, false
+	}
+
 	// If it's disabled, we're just checking syntax
 	if !enabled {
 		return nil, true
@@ -219,6 +337,14 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 	flw.SetRotateLines(maxlines)
 	flw.SetRotateSize(maxsize)
 	flw.SetRotateDaily(daily)
+	flw.SetRecovery(recovery)
+	if size > 0 {
+		flw.SetBufferSize(size)
+	}
+	flw.SetOverflow(overflow)
+	if enc != nil {
+		flw.SetEncoder(enc)
+	}
 	return flw, true
 }
 
@@ -228,6 +354,7 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 	maxsize := 0
 	daily := false
 	rotate := false
+	var recprops, bufprops []xmlProperty
 
 	// Parse properties
 	for _, prop := range props {
@@ -242,6 +369,10 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 			daily = strings.Trim(prop.Value, " \r\n") != "false"
 		case "rotate":
 			rotate = strings.Trim(prop.Value, " \r\n") != "false"
+		case "recovery", "retries", "backoff":
+			recprops = append(recprops, prop)
+		case "buffersize", "overflow", "overflowtimeout", "overflowlevel":
+			bufprops = append(bufprops, prop)
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for xml filter in %s\n", prop.Name, filename)
 		}
@@ -253,6 +384,12 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 		return nil, false
 	}
 
+	recovery, good := xmlToRecovery(filename, recprops)
+	size, overflow, sized := xmlToOverflow(filename, bufprops)
+	if !good || !sized {
+		return nil, false
+	}
+
 	// If it's disabled, we're just checking syntax
 	if !enabled {
 		return nil, true
@@ -262,12 +399,111 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 	xlw.SetRotateLines(maxrecords)
 	xlw.SetRotateSize(maxsize)
 	xlw.SetRotateDaily(daily)
+	xlw.SetRecovery(recovery)
+	if size > 0 {
+		xlw.SetBufferSize(size)
+	}
+	xlw.SetOverflow(overflow)
 	return xlw, true
 }
 
-func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (SocketLogWriter, bool) {
+func xmlToSamplingLogWriter(filename string, xs *xmlSampling, w LogWriter, enabled bool) (LogWriter, bool) {
+	tick := time.Second
+	first, thereafter := 0, 0
+	good := true
+
+	if len(xs.Tick) > 0 {
+		d, err := time.ParseDuration(strings.Trim(xs.Tick, " \r\n"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse sampling attribute \"%s\" in %s: %s\n", "tick", filename, err)
+			good = false
+		}
+		tick = d
+	}
+	if len(xs.First) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required sampling attribute \"%s\" missing in %s\n", "first", filename)
+		good = false
+	}
+	first = strToNumSuffix(strings.Trim(xs.First, " \r\n"), 1000)
+	thereafter = strToNumSuffix(strings.Trim(xs.Thereafter, " \r\n"), 1000)
+
+	// If it's disabled, we're just checking syntax
+	if !good || !enabled {
+		return w, good
+	}
+
+	return NewSamplingLogWriter(w, tick, first, thereafter), true
+}
+
+// Build the matcher of a filter: the conditions of a <match> must all hold,
+// and any one of several <match> elements must match.
+func xmlToMatcher(filename string, xms []xmlMatch) (Matcher, bool) {
+	var alts []Matcher
+	good := true
+	level := func(str string) Level {
+		lvl, ok := strToLevel(strings.Trim(str, " \r\n"))
+		if !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown level in <match> in %s: %s\n", filename, str)
+			good = false
+		}
+		return lvl
+	}
+
+	for _, xm := range xms {
+		var all []Matcher
+		if len(xm.MinLevel) > 0 || len(xm.MaxLevel) > 0 {
+			min, max := FINEST, CRITICAL
+			if len(xm.MinLevel) > 0 {
+				min = level(xm.MinLevel)
+			}
+			if len(xm.MaxLevel) > 0 {
+				max = level(xm.MaxLevel)
+			}
+			all = append(all, MatchLevelRange(min, max))
+		}
+		if len(xm.Levels) > 0 {
+			var lvls []Level
+			for _, str := range strings.Fields(xm.Levels) {
+				lvls = append(lvls, level(str))
+			}
+			all = append(all, MatchLevels(lvls...))
+		}
+		if len(xm.Source) > 0 {
+			re, err := regexp.Compile(strings.Trim(xm.Source, " \r\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse <source> in <match> in %s: %s\n", filename, err)
+				good = false
+			} else {
+				all = append(all, MatchSource(re))
+			}
+		}
+		if len(xm.Message) > 0 {
+			all = append(all, MatchMessage(xm.Message))
+		}
+		for _, xf := range xm.Field {
+			if len(xf.Key) == 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required attribute %s for <field> in <match> missing in %s\n", "key", filename)
+				good = false
+			} else if value := strings.Trim(xf.Value, " \r\n"); len(value) > 0 {
+				all = append(all, MatchFieldValue(xf.Key, value))
+			} else {
+				all = append(all, MatchField(xf.Key))
+			}
+		}
+		alts = append(alts, MatchAll(all...))
+	}
+
+	if len(alts) == 1 {
+		return alts[0], good
+	}
+	return MatchAny(alts...), good
+}
+
+func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (*SocketLogWriter, bool) {
 	endpoint := ""
 	protocol := "udp"
+	encoder := ""
+	var recprops, bufprops []xmlProperty
 
 	// Parse properties
 	for _, prop := range props {
@@ -276,6 +512,12 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 			endpoint = strings.Trim(prop.Value, " \r\n")
 		case "protocol":
 			protocol = strings.Trim(prop.Value, " \r\n")
+		case "recovery", "retries", "backoff":
+			recprops = append(recprops, prop)
+		case "buffersize", "overflow", "overflowtimeout", "overflowlevel":
+			bufprops = append(bufprops, prop)
+		case "encoder":
+			encoder = strings.Trim(prop.Value, " \r\n")
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
 		}
@@ -287,10 +529,190 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 		return nil, false
 	}
 
+	recovery, good := xmlToRecovery(filename, recprops)
+	size, overflow, sized := xmlToOverflow(filename, bufprops)
+	enc, encoded := xmlToEncoder(filename, encoder, FORMAT_DEFAULT)
+	if !good || !sized || !encoded {
+		return nil, false
+	}
+
 	// If it's disabled, we're just checking syntax
 	if !enabled {
 		return nil, true
 	}
 
-	return NewSocketLogWriter(protocol, endpoint), true
+	slw := NewSocketLogWriter(protocol, endpoint).SetRecovery(recovery)
+	if size > 0 {
+		slw.SetBufferSize(size)
+	}
+	if enc != nil {
+		slw.SetEncoder(enc)
+	}
+	return slw.SetOverflow(overflow), true
+}
+
+// Parse the <redact> element of a configuration
+func xmlToRedactor(filename string, xr *xmlRedact) (*Redactor, bool) {
+	r := NewRedactor()
+	good := true
+	if len(xr.Placeholder) > 0 {
+		r.SetPlaceholder(xr.Placeholder)
+	}
+	if len(xr.Keep) > 0 {
+		n, err := strconv.Atoi(xr.Keep)
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid keep \"%s\" for <redact> in %s\n", xr.Keep, filename)
+			good = false
+		}
+		r.SetKeep(n)
+	}
+	for _, xk := range xr.Key {
+		glob := strings.Trim(xk.Glob, " \r\n")
+		if len(glob) == 0 {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Empty <key> in <redact> in %s\n", filename)
+			good = false
+			continue
+		}
+		mode, found := RedactMask, len(xk.Mode) == 0
+		for m, name := range redactModeNames {
+			if xk.Mode == name {
+				mode, found = RedactMode(m), true
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid mode \"%s\" for <key> in <redact> in %s: want mask, hash or truncate\n", xk.Mode, filename)
+			good = false
+			continue
+		}
+		r.RedactKeys(mode, glob)
+	}
+	for _, xm := range xr.Message {
+		switch xm.Builtin {
+		case "card":
+			r.RedactCards()
+		case "email":
+			r.RedactEmails()
+		case "ip":
+			r.RedactIPs()
+		case "":
+			re, err := regexp.Compile(strings.Trim(xm.Pattern, " \r\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse <message> in <redact> in %s: %s\n", filename, err)
+				good = false
+				continue
+			}
+			replace := xm.Replace
+			if len(replace) == 0 {
+				replace = r.placeholder
+			}
+			r.RedactMessage(re, replace)
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid builtin \"%s\" for <message> in <redact> in %s: want card, email or ip\n", xm.Builtin, filename)
+			good = false
+		}
+	}
+	return r, good
+}
+
+// Parse the encoder property of a filter, which is empty if it is not set
+func xmlToEncoder(filename, encoder, format string) (Encoder, bool) {
+	switch encoder {
+	case "":
+		return nil, true
+	case "text":
+		return NewTextEncoder(format), true
+	case "json":
+		return NewJSONEncoder(), true
+	case "ecs":
+		return NewJSONEncoderWithConfig(ECSEncoderConfig()), true
+	case "gelf":
+		return NewJSONEncoderWithConfig(GELFEncoderConfig()), true
+	case "logfmt":
+		return NewLogfmtEncoder(), true
+	}
+	fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid encoder \"%s\" in %s: want text, json, ecs, gelf or logfmt\n", encoder, filename)
+	return nil, false
+}
+
+// Parse the buffersize, overflow, overflowtimeout and overflowlevel properties
+// of a filter
+func xmlToOverflow(filename string, props []xmlProperty) (int, Overflow, bool) {
+	size := 0
+	var o Overflow
+	good := true
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		switch prop.Name {
+		case "buffersize":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid buffersize \"%s\" in %s\n", value, filename)
+				good = false
+			}
+			size = n
+		case "overflow":
+			found := false
+			for p, name := range overflowPolicyNames {
+				if value == name {
+					o.Policy, found = OverflowPolicy(p), true
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid overflow \"%s\" in %s: want one of %s\n", value, filename, strings.Join(overflowPolicyNames, ", "))
+				good = false
+			}
+		case "overflowtimeout":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid overflowtimeout \"%s\" in %s: %s\n", value, filename, err)
+				good = false
+			}
+			o.Timeout = d
+		case "overflowlevel":
+			lvl, ok := strToLevel(value)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid overflowlevel \"%s\" in %s\n", value, filename)
+				good = false
+			}
+			o.Level = lvl
+		}
+	}
+	return size, o, good
+}
+
+// Parse the recovery, retries and backoff properties of a filter
+func xmlToRecovery(filename string, props []xmlProperty) (Recovery, bool) {
+	r := DefaultRecovery
+	good := true
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		switch prop.Name {
+		case "recovery":
+			found := false
+			for p, name := range recoveryPolicyNames {
+				if value == name {
+					r.Policy, found = RecoveryPolicy(p), true
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid recovery \"%s\" in %s: want drop, retry or stderr\n", value, filename)
+				good = false
+			}
+		case "retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid retries \"%s\" in %s\n", value, filename)
+				good = false
+			}
+			r.Retries = n
+		case "backoff":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid backoff \"%s\" in %s: %s\n", value, filename, err)
+				good = false
+			}
+			r.Backoff = d
+		}
+	}
+	return r, good
 }
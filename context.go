@@ -0,0 +1,51 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// A ContextExtractor returns the fields to add to a record logged with a
+// context, such as the trace and span IDs stored in it.
+type ContextExtractor func(ctx context.Context) []Field
+
+var (
+	contextExtractorsMu sync.Mutex
+	contextExtractors   atomic.Value // []ContextExtractor
+)
+
+// RegisterContextExtractor adds extract to the functions that are called for
+// every record logged through DebugCtx, InfoCtx, WarnCtx, ErrorCtx and the
+// like.  The fields they return are added to the record, in the order in
+// which the extractors were registered, before the fields of the call.
+func RegisterContextExtractor(extract ContextExtractor) {
+	contextExtractorsMu.Lock()
+	defer contextExtractorsMu.Unlock()
+	old, _ := contextExtractors.Load().([]ContextExtractor)
+	contextExtractors.Store(append(old[:len(old):len(old)], extract))
+}
+
+// contextFields returns the fields the registered extractors find in ctx.
+func contextFields(ctx context.Context) []Field {
+	if ctx == nil {
+		return nil
+	}
+	var fields []Field
+	extractors, _ := contextExtractors.Load().([]ContextExtractor)
+	for _, extract := range extractors {
+		fields = append(fields, extract(ctx)...)
+	}
+	return fields
+}
+
+// withContext returns the fields found in ctx followed by fields.
+func withContext(ctx context.Context, fields []Field) []Field {
+	extracted := contextFields(ctx)
+	if len(extracted) == 0 {
+		return fields
+	}
+	return append(extracted, fields...)
+}
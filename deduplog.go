@@ -0,0 +1,118 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// This log writer folds consecutive records with the same level, source and
+// message into a single "last message repeated N times" record before passing
+// them on to another LogWriter.
+type DedupLogWriter struct {
+	LogWriter
+
+	timeout time.Duration
+
+	mu       sync.Mutex
+	active   bool // whether last holds a record
+	last     dedupKey
+	name     string
+	repeated int
+	timer    *time.Timer
+}
+
+type dedupKey struct {
+	lvl Level
+	src string
+	msg string
+}
+
+// NewDedupLogWriter creates a new LogWriter which passes the first of a run of
+// identical records on to w and counts the rest.  The count is written as a
+// record of its own when a different record arrives, when w is closed, or
+// timeout after the first repeat if timeout is not 0.
+func NewDedupLogWriter(w LogWriter, timeout time.Duration) *DedupLogWriter {
+	return &DedupLogWriter{
+		LogWriter: w,
+		timeout:   timeout,
+	}
+}
+
+// This is the DedupLogWriter's output method
+func (d *DedupLogWriter) LogWrite(rec *LogRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := dedupKey{rec.Level, rec.Source, rec.Message}
+	if d.active && key == d.last {
+		d.repeated++
+		if d.repeated == 1 && d.timeout > 0 {
+			d.timer = time.AfterFunc(d.timeout, d.expire)
+		}
+		return
+	}
+
+	d.flush()
+	d.active, d.last, d.name = true, key, rec.Name
+	d.LogWriter.LogWrite(rec)
+}
+
+// expire writes the count of a run that is still going on when the timeout
+// elapses.  Repeats after that start a new count.
+func (d *DedupLogWriter) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flush()
+}
+
+// flush writes the count of the current run, if any.  It must be called with
+// d.mu held.
+func (d *DedupLogWriter) flush() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.repeated == 0 {
+		return
+	}
+	d.LogWriter.LogWrite(&LogRecord{
+		Level:   d.last.lvl,
+		Created: time.Now(),
+		Source:  d.last.src,
+		Message: fmt.Sprintf("last message repeated %d times", d.repeated),
+		Name:    d.name,
+	})
+	d.repeated = 0
+}
+
+// Flush writes the count of the current run, if any, and flushes the
+// underlying LogWriter if it is a Flusher.  Repeats after that start a new
+// count.
+func (d *DedupLogWriter) Flush() error {
+	d.mu.Lock()
+	d.flush()
+	d.mu.Unlock()
+	return flushWriter(d.LogWriter)
+}
+
+// Health reports the Health of the underlying LogWriter, which is healthy if
+// it is not a HealthReporter.
+func (d *DedupLogWriter) Health() Health {
+	if h, ok := writerHealthOf(d.LogWriter); ok {
+		return h
+	}
+	return Health{Healthy: true}
+}
+
+// Close writes the count of the current run, if any, and closes the
+// underlying LogWriter.
+func (d *DedupLogWriter) Close() {
+	d.mu.Lock()
+	d.flush()
+	d.active = false
+	d.mu.Unlock()
+	d.LogWriter.Close()
+}
@@ -1,4 +1,275 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
 package log4go
 
+import (
+	"encoding/base64"
+	"strconv"
+	"time"
+	"unicode"
+)
+
+// A FieldEncoder is what Field.AddTo adds a field to.
+type FieldEncoder interface {
+	AddBool(key string, value bool)
+	AddInt(key string, value int)
+	AddInt32(key string, value int32)
+	AddUint32(key string, value uint32)
+	AddInt64(key string, value int64)
+	AddUint64(key string, value uint64)
+	AddInt8(key string, value int8)
+	AddUint8(key string, value uint8)
+	AddFloat32(key string, value float32)
+	AddFloat64(key string, value float64)
+	AddString(key, value string)
+	// AddInterface adds a value that has no type of field of its own.
+	AddInterface(key string, value interface{})
+	AddStack(key string, frames []StackFrame)
+	AddDuration(key string, value time.Duration)
+	AddTime(key string, value time.Time)
+	AddBinary(key string, value []byte)
+	AddObject(key string, obj ObjectMarshaler) error
+	AddArray(key string, arr ArrayMarshaler) error
+	// OpenNamespace puts the fields added after it, up to the end of the
+	// record or object, in an object named key.
+	OpenNamespace(key string)
+}
+
+// An Encoder turns records, fields included, into the text a LogWriter
+// writes.  An Encoder is used by one goroutine at a time; LogWriters given
+// one with SetEncoder use a Clone of their own.
 type Encoder interface {
+	FieldEncoder
+
+	// EncodeRecord returns rec as an entry of output, newline included.
+	EncodeRecord(rec *LogRecord) string
+
+	// Clone returns a new Encoder with the same settings.
+	Clone() Encoder
+}
+
+// encoderNeedsCaller reports whether enc, or FormatLogRecord with format if
+// enc is nil, uses the source or function of records.
+func encoderNeedsCaller(enc Encoder, format string) bool {
+	if enc == nil {
+		return formatNeedsCaller(format)
+	}
+	if cn, ok := enc.(CallerNeeder); ok {
+		return cn.NeedsCaller()
+	}
+	return true
+}
+
+// NewJSONEncoder returns an Encoder that writes each record as a JSON object
+// on a line of its own.
+func NewJSONEncoder() Encoder {
+	return newJsonEncoder()
+}
+
+// NewJSONEncoderWithConfig returns an Encoder that writes each record as a
+// JSON object with the schema of cfg, on a line of its own.
+func NewJSONEncoderWithConfig(cfg JSONEncoderConfig) Encoder {
+	enc := newJsonEncoder()
+	enc.cfg = cfg.withDefaults()
+	return enc
+}
+
+func (enc *jsonEncoder) EncodeRecord(rec *LogRecord) string {
+	text := enc.EncodeJson(rec)
+	enc.buf = enc.buf[:0]
+	return text
+}
+
+func (enc *jsonEncoder) Clone() Encoder {
+	clone := newJsonEncoder()
+	clone.cfg = enc.cfg
+	return clone
+}
+
+// NeedsCaller reports whether the schema has the source or function.
+func (enc *jsonEncoder) NeedsCaller() bool {
+	return !enc.cfg.OmitCaller
+}
+
+// NewTextEncoder returns an Encoder that writes records as FormatLogRecord
+// does, with the fields following the message as key:value pairs and stacks
+// on indented lines of their own.
+func NewTextEncoder(format string) Encoder {
+	return &textEncoder{format: format}
+}
+
+type textEncoder struct {
+	format string
+	buf    []byte
+	ns     string         // put in front of keys inside objects and namespaces
+	colors *ConsoleColors // if set, the colours of the level, keys and values
+}
+
+func (enc *textEncoder) EncodeRecord(rec *LogRecord) string {
+	return formatLogRecord(enc.format, rec, enc.message(rec), enc.colors)
+}
+
+// message returns the message of rec followed by its fields, separated by
+// spaces.
+func (enc *textEncoder) message(rec *LogRecord) string {
+	enc.buf = append(enc.buf[:0], rec.Message...)
+	enc.ns = ""
+	n := len(enc.buf)
+	for _, f := range rec.Fields {
+		f.AddTo(enc)
+	}
+	if len(enc.buf) == n {
+		return rec.Message
+	}
+	return string(enc.buf)
+}
+
+// NeedsCaller reports whether the format uses the source or function.
+func (enc *textEncoder) NeedsCaller() bool {
+	return formatNeedsCaller(enc.format)
+}
+
+func (enc *textEncoder) Clone() Encoder {
+	return &textEncoder{format: enc.format, colors: enc.colors}
+}
+
+// addKey starts a field, after a space if anything comes before it.  Keys are
+// written after the keys of the objects and namespaces they are in, quoted as
+// values are if they need to be.
+func (enc *textEncoder) addKey(key string) {
+	if len(enc.buf) > 0 {
+		enc.buf = append(enc.buf, ' ')
+	}
+	colored := enc.colors != nil && enc.colors.Key != ""
+	if colored {
+		enc.buf = append(enc.buf, sgr(enc.colors.Key)...)
+	}
+	enc.buf = appendText(enc.buf, enc.ns+key)
+	enc.buf = append(enc.buf, ':')
+	if colored {
+		enc.buf = append(enc.buf, colorReset...)
+	}
+	if enc.colors != nil && enc.colors.Value != "" {
+		enc.buf = append(enc.buf, sgr(enc.colors.Value)...)
+	}
+}
+
+// endValue ends a field.
+func (enc *textEncoder) endValue() {
+	if enc.colors != nil && enc.colors.Value != "" {
+		enc.buf = append(enc.buf, colorReset...)
+	}
+}
+
+// appendText appends s to buf, quoted and escaped as a Go string if it has
+// characters that are not printable, such as newlines, which would break the
+// line.
+func appendText(buf []byte, s string) []byte {
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return strconv.AppendQuote(buf, s)
+		}
+	}
+	return append(buf, s...)
+}
+
+func (enc *textEncoder) AddBool(key string, value bool) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendBool(enc.buf, value)
+	enc.endValue()
+}
+
+func (enc *textEncoder) AddInt(key string, value int) {
+	enc.AddInt64(key, int64(value))
+}
+
+func (enc *textEncoder) AddInt32(key string, value int32) {
+	enc.AddInt64(key, int64(value))
+}
+
+func (enc *textEncoder) AddUint32(key string, value uint32) {
+	enc.AddUint64(key, uint64(value))
+}
+
+func (enc *textEncoder) AddInt64(key string, value int64) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendInt(enc.buf, value, 10)
+	enc.endValue()
+}
+
+func (enc *textEncoder) AddUint64(key string, value uint64) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendUint(enc.buf, value, 10)
+	enc.endValue()
+}
+
+func (enc *textEncoder) AddInt8(key string, value int8) {
+	enc.AddInt64(key, int64(value))
+}
+
+func (enc *textEncoder) AddUint8(key string, value uint8) {
+	enc.AddUint64(key, uint64(value))
+}
+
+func (enc *textEncoder) AddFloat32(key string, value float32) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendFloat(enc.buf, float64(value), 'f', -1, 32)
+	enc.endValue()
+}
+
+func (enc *textEncoder) AddFloat64(key string, value float64) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendFloat(enc.buf, value, 'f', -1, 64)
+	enc.endValue()
+}
+
+func (enc *textEncoder) AddString(key, value string) {
+	enc.addKey(key)
+	enc.buf = appendText(enc.buf, value)
+	enc.endValue()
+}
+
+func (enc *textEncoder) AddInterface(key string, value interface{}) {
+	enc.addKey(key)
+	enc.buf = appendText(enc.buf, reflectedText(value))
+	enc.endValue()
+}
+
+// AddStack does nothing: formatLogRecord writes stacks after the line.
+func (enc *textEncoder) AddStack(key string, frames []StackFrame) {}
+
+func (enc *textEncoder) AddDuration(key string, value time.Duration) {
+	enc.AddString(key, value.String())
+}
+
+func (enc *textEncoder) AddTime(key string, value time.Time) {
+	enc.addKey(key)
+	enc.buf = value.AppendFormat(enc.buf, time.RFC3339Nano)
+	enc.endValue()
+}
+
+func (enc *textEncoder) AddBinary(key string, value []byte) {
+	enc.AddString(key, base64.StdEncoding.EncodeToString(value))
+}
+
+// AddObject adds the fields of obj with their keys after key and a dot.
+func (enc *textEncoder) AddObject(key string, obj ObjectMarshaler) error {
+	ns := enc.ns
+	enc.ns += key + "."
+	err := obj.MarshalLogObject(enc)
+	enc.ns = ns
+	return err
+}
+
+// AddArray adds arr as JSON.
+func (enc *textEncoder) AddArray(key string, arr ArrayMarshaler) error {
+	value, err := jsonArray(arr)
+	enc.addKey(key)
+	enc.buf = append(enc.buf, value...)
+	enc.endValue()
+	return err
+}
+
+func (enc *textEncoder) OpenNamespace(key string) {
+	enc.ns += key + "."
 }
@@ -1,5 +1,12 @@
 package log4go
 
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
 type FieldType uint8
 
 const (
@@ -16,8 +23,22 @@ const (
 	Float32Type
 	StringType
 	InterfaceType
+	StackType
+	ObjectType
+	ArrayType
+	NamespaceType
+	DurationType
+	TimeType
+	BinaryType
+	ErrorType
 )
 
+// A Field is a key and value added to a record.  Records are encoded later,
+// on the goroutines of the writers, so the logging methods copy what the
+// values of their fields refer to: byte slices, the slices of Bools, Ints and
+// the like, and the values Any writes as JSON.  The ObjectMarshalers,
+// ArrayMarshalers and errors of fields are encoded as they are, and must not
+// be changed once they are logged.
 type Field struct {
 	Key       string
 	Type      FieldType
@@ -26,7 +47,9 @@ type Field struct {
 	Interface interface{}
 }
 
-func (f Field) AddTo(enc *jsonEncoder) {
+// AddTo adds f to enc.  The errors of marshalers are added as a string
+// field named after f, with "Error" appended.
+func (f Field) AddTo(enc FieldEncoder) {
 	switch f.Type {
 	case BoolType:
 		enc.AddBool(f.Key, f.Interface.(bool))
@@ -43,7 +66,7 @@ func (f Field) AddTo(enc *jsonEncoder) {
 	case Int8Type:
 		enc.AddInt8(f.Key, int8(f.Integer))
 	case Uint8Type:
-		enc.AddUint8(f.Key, int8(f.Integer))
+		enc.AddUint8(f.Key, uint8(f.Integer))
 	case Float32Type:
 		enc.AddFloat32(f.Key, f.Interface.(float32))
 	case Float64Type:
@@ -52,9 +75,67 @@ func (f Field) AddTo(enc *jsonEncoder) {
 		enc.AddString(f.Key, f.String)
 	case InterfaceType:
 		enc.AddInterface(f.Key, f.Interface)
+	case StackType:
+		enc.AddStack(f.Key, f.Interface.([]StackFrame))
+	case ObjectType:
+		if err := enc.AddObject(f.Key, f.Interface.(ObjectMarshaler)); err != nil {
+			enc.AddString(f.Key+"Error", err.Error())
+		}
+	case ArrayType:
+		if err := enc.AddArray(f.Key, f.Interface.(ArrayMarshaler)); err != nil {
+			enc.AddString(f.Key+"Error", err.Error())
+		}
+	case NamespaceType:
+		enc.OpenNamespace(f.Key)
+	case DurationType:
+		enc.AddDuration(f.Key, time.Duration(f.Integer))
+	case TimeType:
+		enc.AddTime(f.Key, f.Interface.(time.Time))
+	case BinaryType:
+		enc.AddBinary(f.Key, f.Interface.([]byte))
+	case ErrorType:
+		f.addError(enc)
 	}
 }
 
+// addError adds the text of the error of an ErrorType field under its key.
+// Errors that are not nil also add their type, and if they have them their
+// causes, stack and fields, under the key followed by "Type", "Causes",
+// "Stack" and "Fields".
+func (f Field) addError(enc FieldEncoder) {
+	err, _ := f.Interface.(error)
+	if err == nil {
+		enc.AddString(f.Key, "nil")
+		return
+	}
+	enc.AddString(f.Key, err.Error())
+	enc.AddString(f.Key+"Type", fmt.Sprintf("%T", err))
+	causes := errorCauses(err)
+	if len(causes) > 0 {
+		texts := make([]string, len(causes))
+		for i, cause := range causes {
+			texts[i] = cause.Error()
+		}
+		enc.AddArray(f.Key+"Causes", stringArray(texts))
+	}
+	if frames := errorStack(err, causes); frames != nil {
+		enc.AddStack(f.Key+"Stack", frames)
+	}
+	if obj, ok := err.(ObjectMarshaler); ok {
+		if merr := enc.AddObject(f.Key+"Fields", obj); merr != nil {
+			enc.AddString(f.Key+"FieldsError", merr.Error())
+		}
+	}
+}
+
+// errorString returns the text of the error of an ErrorType field.
+func (f Field) errorString() string {
+	if f.Interface == nil {
+		return "nil"
+	}
+	return f.Interface.(error).Error()
+}
+
 func Bool(key string, value bool) Field {
 	return Field{Key: key, Type: BoolType, Interface: value}
 }
@@ -75,7 +156,7 @@ func Int8(key string, value int8) Field {
 	return Field{Key: key, Type: Int8Type, Integer: int64(value)}
 }
 
-// Uint64 warning: max is int64
+// Uint64 keeps the bits of value in Integer, so the full range is written.
 func Uint64(key string, value uint64) Field {
 	return Field{Key: key, Type: Uint64Type, Integer: int64(value)}
 }
@@ -100,46 +181,262 @@ func String(key string, value string) Field {
 	return Field{Key: key, Type: StringType, String: value}
 }
 
+// Err returns a field holding err under the key "error".
 func Err(err error) Field {
-	value := "nil"
-	if err != nil {
-		value = err.Error()
+	return NamedErr("error", err)
+}
+
+// NamedErr returns a field holding err under key.  Besides its text, the
+// type of err is written, and the causes errors.Unwrap finds in it, the stack
+// of the first of them that is a StackError, and the fields of err if it is
+// an ObjectMarshaler.  A nil err is written as "nil".
+func NamedErr(key string, err error) Field {
+	return Field{Key: key, Type: ErrorType, Interface: err}
+}
+
+// Duration returns a field holding value, written with its unit.
+func Duration(key string, value time.Duration) Field {
+	return Field{Key: key, Type: DurationType, Integer: int64(value)}
+}
+
+// Time returns a field holding value, written in the time format of the
+// encoder.
+func Time(key string, value time.Time) Field {
+	return Field{Key: key, Type: TimeType, Interface: value}
+}
+
+// Stringer returns a field holding the String of value, which is called
+// at once: records are encoded later, on other goroutines.
+func Stringer(key string, value fmt.Stringer) Field {
+	return String(key, stringOf(value))
+}
+
+// Binary returns a field holding value, written in base64.
+func Binary(key string, value []byte) Field {
+	return Field{Key: key, Type: BinaryType, Interface: value}
+}
+
+// stringOf returns the String of value, or the panic it raises doing so, as
+// for nil pointers.
+func stringOf(value fmt.Stringer) (s string) {
+	defer func() {
+		if r := recover(); r != nil {
+			s = fmt.Sprintf("<PANIC=%v>", r)
+		}
+	}()
+	if value == nil {
+		return "<nil>"
 	}
-	return Field{Key: "error", Type: StringType, String: value}
+	return value.String()
+}
+
+// Stack returns a field with the stack of the calling goroutine, without the
+// frames of the runtime.
+func Stack(key string) Field {
+	return Field{Key: key, Type: StackType, Interface: stackFrames(1)}
 }
 
+// Any returns a field holding value, with the type of field that suits it.
+// Values with no field of their own are written as JSON.
 func Any(key string, value interface{}) Field {
-	f := Field{
-		Key: key,
-	}
-	switch value.(type) {
+	switch v := value.(type) {
+	case bool:
+		return Bool(key, v)
 	case int:
-		f.Integer = int64(value.(int))
-		f.Type = IntType
-	case uint8:
-		f.Integer = int64(value.(uint8))
-		f.Type = IntType
+		return Int(key, v)
 	case int8:
-		f.Integer = int64(value.(int8))
-		f.Type = IntType
-	case uint32:
-		f.Integer = int64(value.(uint32))
-		f.Type = IntType
+		return Int8(key, v)
+	case uint8:
+		return Uint8(key, v)
+	case int16:
+		return Int32(key, int32(v))
+	case uint16:
+		return Uint32(key, uint32(v))
 	case int32:
-		f.Integer = int64(value.(int32))
-		f.Type = IntType
-	case uint64:
-		f.Integer = int64(value.(uint64))
-		f.Type = IntType
+		return Int32(key, v)
+	case uint32:
+		return Uint32(key, v)
 	case int64:
-		f.Integer = int64(value.(int64))
-		f.Type = IntType
+		return Int64(key, v)
+	case uint64:
+		return Uint64(key, v)
+	case uint:
+		return Uint64(key, uint64(v))
+	case float32:
+		return Float32(key, v)
+	case float64:
+		return Float64(key, v)
 	case string:
-		f.String = value.(string)
-		f.Type = StringType
-	default:
-		f.Type = InterfaceType
-		f.Interface = value
+		return String(key, v)
+	case time.Duration:
+		return Duration(key, v)
+	case time.Time:
+		return Time(key, v)
+	case []byte:
+		return Binary(key, v)
+	case ObjectMarshaler:
+		return Object(key, v)
+	case ArrayMarshaler:
+		return Array(key, v)
+	case []bool:
+		return Bools(key, v)
+	case []int:
+		return Ints(key, v)
+	case []int32:
+		return Int32s(key, v)
+	case []int64:
+		return Int64s(key, v)
+	case []uint32:
+		return Uint32s(key, v)
+	case []uint64:
+		return Uint64s(key, v)
+	case []float32:
+		return Float32s(key, v)
+	case []float64:
+		return Float64s(key, v)
+	case []string:
+		return Strings(key, v)
+	case error:
+		return NamedErr(key, v)
+	case fmt.Stringer:
+		return Stringer(key, v)
+	}
+	return Field{Key: key, Type: InterfaceType, Interface: value}
+}
+
+// rawJSON is the JSON of the value of a field, taken when it was logged.
+type rawJSON string
+
+func (r rawJSON) MarshalJSON() ([]byte, error) {
+	return []byte(r), nil
+}
+
+func (r rawJSON) String() string {
+	return string(r)
+}
+
+// snapshotFields returns a copy of fields in which the values that the caller
+// may still change are copied, or, for the values of Any, written as JSON.
+func snapshotFields(fields []Field) []Field {
+	if len(fields) == 0 {
+		return nil
+	}
+	dup := make([]Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case BinaryType:
+			f.Interface = append([]byte(nil), f.Interface.([]byte)...)
+		case ArrayType:
+			f.Interface = copyArray(f.Interface.(ArrayMarshaler))
+		case InterfaceType:
+			switch f.Interface.(type) {
+			case nil, error, fmt.Stringer:
+			default:
+				f.Interface = rawJSON(reflectedText(f.Interface))
+			}
+		}
+		dup[i] = f
+	}
+	return dup
+}
+
+// A StackError is an error that knows the stack it was created on, as the
+// program counters runtime.Callers returns.
+type StackError interface {
+	error
+	Callers() []uintptr
+}
+
+// maxErrorCauses limits how many causes of an error are written.
+const maxErrorCauses = 32
+
+// errorCauses returns the errors err wraps, depth first.
+func errorCauses(err error) []error {
+	var causes []error
+	next := unwrapError(err)
+	for len(next) > 0 && len(causes) < maxErrorCauses {
+		cause := next[0]
+		next = next[1:]
+		if cause == nil {
+			continue
+		}
+		causes = append(causes, cause)
+		next = append(unwrapError(cause), next...)
+	}
+	return causes
+}
+
+// unwrapError returns the errors err wraps directly.
+func unwrapError(err error) []error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return []error{e.Unwrap()}
+	case interface{ Unwrap() []error }:
+		return e.Unwrap()
+	}
+	return nil
+}
+
+// errorStack returns the stack of the first of err and its causes that is a
+// StackError, or nil if none is.
+func errorStack(err error, causes []error) []StackFrame {
+	for _, e := range append([]error{err}, causes...) {
+		if se, ok := e.(StackError); ok {
+			return callersFrames(se.Callers())
+		}
+	}
+	return nil
+}
+
+// frames returns the stack f holds: that of a Stack field, or of the error of
+// an error field.
+func (f Field) frames() []StackFrame {
+	switch f.Type {
+	case StackType:
+		return f.Interface.([]StackFrame)
+	case ErrorType:
+		if err, ok := f.Interface.(error); ok {
+			return errorStack(err, errorCauses(err))
+		}
+	}
+	return nil
+}
+
+// A StackFrame is a frame of the stack held by a Stack field.
+type StackFrame struct {
+	Func string
+	File string
+	Line int
+}
+
+func (f StackFrame) String() string {
+	return fmt.Sprintf("%s (%s:%d)", f.Func, f.File, f.Line)
+}
+
+// maxStackFrames limits how deep a stack is kept.
+const maxStackFrames = 32
+
+// stackFrames returns the stack above the caller skip frames above the caller
+// of stackFrames, without the frames of the runtime.
+func stackFrames(skip int) []StackFrame {
+	pcs := make([]uintptr, maxStackFrames)
+	n := runtime.Callers(skip+2, pcs)
+	return callersFrames(pcs[:n])
+}
+
+// callersFrames returns the frames of the program counters pcs, without the
+// frames of the runtime.
+func callersFrames(pcs []uintptr) []StackFrame {
+	frames := runtime.CallersFrames(pcs)
+	stack := make([]StackFrame, 0, len(pcs))
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			stack = append(stack, StackFrame{frame.Function, frame.File, frame.Line})
+		}
+		if !more {
+			break
+		}
 	}
-	return f
+	return stack
 }
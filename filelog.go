@@ -10,15 +10,18 @@ import (
 
 // This log writer sends output to a file
 type FileLogWriter struct {
-	rec chan *LogRecord
-	rot chan bool
+	queue  *recordQueue
+	rot    chan bool
+	done   chan struct{} // closed when the writing goroutine returns
+	health *writerHealth
 
 	// The opened file
 	filename string
 	file     *os.File
 
-	// The logging format
-	format string
+	// The logging format, or the encoder used in its place
+	format  string
+	encoder Encoder
 
 	// File header/trailer
 	header, trailer string
@@ -40,19 +43,40 @@ type FileLogWriter struct {
 	maxbackup int
 }
 
-// This is the FileLogWriter's output method
+// This is the FileLogWriter's output method.  What it does when the output
+// buffer is full depends on its Overflow; by default it blocks.
 func (w *FileLogWriter) LogWrite(rec *LogRecord) {
-	if rec.Json {
-		encode := getJsonEncoder()
-		rec.Message = encode.EncodeJson(rec)
-		putJsonEncoder(encode)
-	}
-	w.rec <- rec
+	w.queue.push(rec)
+}
+
+// Flush waits until the records passed to the writer so far have been
+// written and synced to disk.  If any record was lost since the last Flush,
+// it returns the error.
+func (w *FileLogWriter) Flush() error {
+	return w.queue.flush()
+}
+
+// ReleasesRecords reports that the writer releases the records passed to it.
+func (w *FileLogWriter) ReleasesRecords() bool {
+	return true
+}
+
+// Health reports the state of the file.
+func (w *FileLogWriter) Health() Health {
+	return w.health.Health()
+}
+
+// Set how the writer recovers from errors writing and rotating (chainable).
+func (w *FileLogWriter) SetRecovery(r Recovery) *FileLogWriter {
+	w.health.setRecovery(r)
+	return w
 }
 
+// Close stops the writer once the records already passed to it are written,
+// and syncs and closes the file.
 func (w *FileLogWriter) Close() {
-	close(w.rec)
-	w.file.Sync()
+	w.queue.close()
+	<-w.done
 }
 
 // NewFileLogWriter creates a new LogWriter which writes to the given file and
@@ -66,8 +90,10 @@ func (w *FileLogWriter) Close() {
 //   [%D %T] [%L] (%S) %M
 func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 	w := &FileLogWriter{
-		rec:       make(chan *LogRecord, LogBufferLength),
+		queue:     newRecordQueue(),
 		rot:       make(chan bool),
+		done:      make(chan struct{}),
+		health:    newWriterHealth(),
 		filename:  fname,
 		format:    "[%D %T] [%L] (%S) %M",
 		rotate:    rotate,
@@ -81,51 +107,93 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 	}
 
 	go func() {
+		defer close(w.done)
 		defer func() {
 			if w.file != nil {
 				fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
+				w.file.Sync()
 				w.file.Close()
 			}
 		}()
 
+		// A failed write or rotation leaves the file in doubt, so it is
+		// opened again, rotating it if rotation is on, before the next write.
+		broken := false
+		rotate := func() error {
+			if err := w.intRotate(); err != nil {
+				broken = true
+				return fmt.Errorf("FileLogWriter(%q): %w", w.filename, err)
+			}
+			broken = false
+			return nil
+		}
+
 		for {
-			select {
-			case <-w.rot:
-				if err := w.intRotate(); err != nil {
-					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
+			// Markers put back in front of the buffer come first.
+			rec := w.queue.popFront()
+			if rec == nil {
+				var ok bool
+				select {
+				case <-w.rot:
+					if err := rotate(); err != nil {
+						handleError(w, err)
+					}
+					continue
+				case <-w.queue.ready:
+					continue
+				case rec, ok = <-w.queue.in:
+					if !ok {
+						if rec = w.queue.popFront(); rec == nil {
+							return
+						}
+					}
 				}
-			case rec, ok := <-w.rec:
-				if !ok {
-					return
+			}
+			if w.queue.switched(rec) {
+				continue
+			}
+			if rec.flush != nil {
+				err := w.health.flushed()
+				if err == nil && !broken {
+					err = w.file.Sync()
 				}
+				rec.flush <- err
+				continue
+			}
+
+			var text string
+			if w.encoder != nil {
+				text = w.encoder.EncodeRecord(rec)
+			} else if rec.Json {
+				encode := getJsonEncoder()
+				text = encode.EncodeJson(rec)
+				putJsonEncoder(encode)
+			} else {
+				text = FormatLogRecord(w.format, rec)
+			}
+			rec.Release()
+			w.health.write(w, text, func() error {
 				now := time.Now()
-				if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
+				if broken || (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
 					(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) ||
 					(w.daily && now.Day() != w.daily_opendate) {
-					if err := w.intRotate(); err != nil {
-						fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-						return
+					if err := rotate(); err != nil {
+						return err
 					}
 				}
 
 				// Perform the write
-				var n int
-				var err error
-				if rec.Json {
-					n, err = fmt.Fprint(w.file, rec.Message)
-				} else {
-					n, err = fmt.Fprint(w.file, FormatLogRecord(w.format, rec))
-				}
+				n, err := fmt.Fprint(w.file, text)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
+					broken = true
+					return fmt.Errorf("FileLogWriter(%q): %w", w.filename, err)
 				}
 
 				// Update the counts
 				w.maxlines_curlines++
 				w.maxsize_cursize += n
-			}
+				return nil
+			})
 		}
 	}()
 
@@ -211,6 +279,33 @@ func (w *FileLogWriter) SetFormat(format string) *FileLogWriter {
 	return w
 }
 
+// Set the size of the output buffer (chainable).  Must be called before the
+// first log message is written.
+func (w *FileLogWriter) SetBufferSize(size int) *FileLogWriter {
+	w.queue.resize(size)
+	return w
+}
+
+// Set what LogWrite does when the output buffer is full (chainable).
+func (w *FileLogWriter) SetOverflow(o Overflow) *FileLogWriter {
+	w.queue.setOverflow(o)
+	return w
+}
+
+// Dropped returns how many records have been dropped because the output
+// buffer was full.
+func (w *FileLogWriter) Dropped() uint64 {
+	return w.queue.dropCount()
+}
+
+// Set the encoder of records, in place of the format for plain records and
+// JSON for structured ones (chainable).  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetEncoder(enc Encoder) *FileLogWriter {
+	w.encoder = enc.Clone()
+	return w
+}
+
 // Set the logfile header and footer (chainable).  Must be called before the first log
 // message is written.  These are formatted similar to the FormatLogRecord (e.g.
 // you can use %D and %T in your header/footer for date and time).
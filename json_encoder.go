@@ -1,9 +1,15 @@
 package log4go
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math"
+	"os"
 	"strconv"
 	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -23,162 +29,472 @@ func putJsonEncoder(enc *jsonEncoder) {
 	jsonEncoderPool.Put(enc)
 }
 
+// A JSONTimeFormat is how a JSON encoder writes the time of records.
+type JSONTimeFormat int
+
+const (
+	// LegacyTime is a string such as "2006-01-02 15:04:05.00000".
+	LegacyTime JSONTimeFormat = iota
+	// RFC3339NanoTime is a string in the time.RFC3339Nano layout.
+	RFC3339NanoTime
+	// EpochMillisTime is a number of milliseconds since the Unix epoch.
+	EpochMillisTime
+	// EpochSecondsTime is a number of seconds since the Unix epoch, with
+	// microseconds after the point.
+	EpochSecondsTime
+)
+
+// A JSONLevelStyle is how a JSON encoder writes the level of records.
+type JSONLevelStyle int
+
+const (
+	// AbbrevLevel is the four letter name, such as "WARN".
+	AbbrevLevel JSONLevelStyle = iota
+	// FullLevel is the full name, such as "WARNING".
+	FullLevel
+	// SyslogLevel is the number of the syslog severity, such as 4.
+	SyslogLevel
+)
+
+var syslogSeverities = [...]int{7, 7, 7, 7, 6, 4, 3, 2}
+
+// A JSONEncoderConfig sets the schema of the objects written by a JSON
+// encoder.  Empty keys are replaced by those of DefaultJSONEncoderConfig.
+type JSONEncoderConfig struct {
+	TimeKey    string
+	MessageKey string
+	LevelKey   string
+	CallerKey  string // the source of the record
+	FuncKey    string // the function, written only if set
+	NameKey    string // the logger, written only for named loggers
+
+	TimeFormat JSONTimeFormat
+	LevelStyle JSONLevelStyle
+	OmitTime   bool
+	OmitCaller bool // omits the source and the function
+
+	FieldPrefix string  // put in front of the keys of fields
+	Static      []Field // written in every object, after the record
+}
+
+// DefaultJSONEncoderConfig is the schema of NewJSONEncoder.
+var DefaultJSONEncoderConfig = JSONEncoderConfig{
+	TimeKey:    "time",
+	MessageKey: "message",
+	LevelKey:   "level",
+	CallerKey:  "file",
+	NameKey:    "logger",
+}
+
+// ECSEncoderConfig returns the schema of the Elastic Common Schema.
+func ECSEncoderConfig() JSONEncoderConfig {
+	return JSONEncoderConfig{
+		TimeKey:    "@timestamp",
+		MessageKey: "message",
+		LevelKey:   "log.level",
+		CallerKey:  "log.origin.file.name",
+		FuncKey:    "log.origin.function",
+		NameKey:    "log.logger",
+		TimeFormat: RFC3339NanoTime,
+		LevelStyle: FullLevel,
+		Static:     []Field{String("ecs.version", "1.6.0")},
+	}
+}
+
+// GELFEncoderConfig returns the schema of the Graylog Extended Log Format
+// 1.1, with the host set to the name of this machine.
+func GELFEncoderConfig() JSONEncoderConfig {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return JSONEncoderConfig{
+		TimeKey:     "timestamp",
+		MessageKey:  "short_message",
+		LevelKey:    "level",
+		CallerKey:   "_file",
+		FuncKey:     "_function",
+		NameKey:     "_logger",
+		TimeFormat:  EpochSecondsTime,
+		LevelStyle:  SyslogLevel,
+		FieldPrefix: "_",
+		Static:      []Field{String("version", "1.1"), String("host", host)},
+	}
+}
+
+// withDefaults returns cfg with the empty keys filled in.
+func (cfg JSONEncoderConfig) withDefaults() *JSONEncoderConfig {
+	def := &DefaultJSONEncoderConfig
+	for _, k := range []struct {
+		key *string
+		def string
+	}{
+		{&cfg.TimeKey, def.TimeKey},
+		{&cfg.MessageKey, def.MessageKey},
+		{&cfg.LevelKey, def.LevelKey},
+		{&cfg.CallerKey, def.CallerKey},
+		{&cfg.FuncKey, def.FuncKey},
+		{&cfg.NameKey, def.NameKey},
+	} {
+		if *k.key == "" {
+			*k.key = k.def
+		}
+	}
+	return &cfg
+}
+
 type jsonEncoder struct {
-	buf  []byte
-	left bool
+	buf    []byte
+	left   bool
+	cfg    *JSONEncoderConfig
+	fields bool // whether the fields of the record are being written
+	nested int  // depth of the objects and arrays being written
+	open   int  // namespaces open in the object being written
 }
 
 func newJsonEncoder() *jsonEncoder {
 	return &jsonEncoder{
 		buf: make([]byte, 0, 100),
+		cfg: &DefaultJSONEncoderConfig,
 	}
 }
 
 func (enc *jsonEncoder) EncodeJson(record *LogRecord) string {
+	cfg := enc.cfg
 	enc.appendByte('{')
-	enc.appendString(`"time":`)
-	enc.appendString(fmt.Sprintf("\"%04d-%02d-%02d %02d:%02d:%02d.%05d\"",
-		record.Created.Year(), record.Created.Month(), record.Created.Day(),
-		record.Created.Hour(), record.Created.Minute(), record.Created.Second(), record.Created.Nanosecond()/10000))
-	enc.appendString(`,"message":`)
-	enc.appendString(`"` + record.Message + `"`)
-	enc.appendString(`,"level":`)
-	enc.appendString(`"` + record.Level.String() + `"`)
-	enc.appendString(`,"file":`)
-	enc.appendString(`"` + record.Source + `"`)
+	enc.left = true
+	if !cfg.OmitTime {
+		enc.addKey(cfg.TimeKey)
+		enc.addTime(record.Created)
+	}
+	enc.AddString(cfg.MessageKey, record.Message)
+	enc.addKey(cfg.LevelKey)
+	enc.addLevel(record.Level)
+	if !cfg.OmitCaller {
+		enc.AddString(cfg.CallerKey, record.Source)
+		if cfg.FuncKey != "" && record.Func != "" {
+			enc.AddString(cfg.FuncKey, record.Func)
+		}
+	}
+	if record.Name != "" && cfg.NameKey != "" {
+		enc.AddString(cfg.NameKey, record.Name)
+	}
+	enc.fields = true
 	for _, f := range record.Fields {
 		if f.Type == UnknownType {
 			continue
 		}
 		f.AddTo(enc)
 	}
+	enc.closeNamespaces()
+	enc.fields = false
+	for _, f := range cfg.Static {
+		f.AddTo(enc)
+	}
 	enc.appendByte('}')
 	enc.appendByte('\n')
 	return string(enc.buf)
 }
 
-func (enc *jsonEncoder) EncodeString(record *LogRecord) string {
-	if len(record.Fields) <= 0 {
-		return record.Message
+// addKey starts a member of the object, escaping its key.  The record's own
+// members are written without a space after the colon.
+func (enc *jsonEncoder) addKey(key string) {
+	enc.AppendLeft()
+	if enc.fields && enc.nested == 0 {
+		enc.safeAddString(enc.cfg.FieldPrefix)
 	}
-	enc.appendString(record.Message)
-	enc.appendByte(' ')
-	args := make([]interface{}, 0, len(record.Fields))
-	for _, f := range record.Fields {
-		if f.Type == UnknownType {
-			continue
-		}
-		enc.appendString(f.Key + ":")
-		switch f.Type {
-		case Int32Type,
-			Uint32Type,
-			Int8Type,
-			Uint8Type,
-			Int64Type,
-			Uint64Type,
-			IntType:
-			enc.appendString("%d")
-			args = append(args, f.Integer)
-		case StringType:
-			enc.appendString("%s")
-			args = append(args, f.String)
-		case BoolType:
-			enc.appendString("%t")
-			args = append(args, f.Interface)
-		default:
-			enc.appendString("%v")
-			args = append(args, f.Interface)
-		}
-		enc.appendByte(' ')
+	if enc.fields {
+		enc.safeAddString(key)
+		enc.appendString(`": `)
+		return
+	}
+	enc.safeAddString(key)
+	enc.appendString(`":`)
+}
+
+func (enc *jsonEncoder) addTime(t time.Time) {
+	switch enc.cfg.TimeFormat {
+	case RFC3339NanoTime:
+		enc.appendByte('"')
+		enc.buf = t.AppendFormat(enc.buf, time.RFC3339Nano)
+		enc.appendByte('"')
+	case EpochMillisTime:
+		enc.buf = strconv.AppendInt(enc.buf, t.UnixNano()/int64(time.Millisecond), 10)
+	case EpochSecondsTime:
+		enc.buf = strconv.AppendFloat(enc.buf, float64(t.UnixNano()/int64(time.Microsecond))/1e6, 'f', 6, 64)
+	default:
+		enc.appendByte('"')
+		enc.buf = t.AppendFormat(enc.buf, "2006-01-02 15:04:05.00000")
+		enc.appendByte('"')
+	}
+}
+
+func (enc *jsonEncoder) addLevel(lvl Level) {
+	if lvl < 0 || int(lvl) >= len(levelNames) {
+		enc.appendString(`"UNKNOWN"`)
+		return
+	}
+	switch enc.cfg.LevelStyle {
+	case FullLevel:
+		enc.appendByte('"')
+		enc.appendString(levelNames[lvl])
+		enc.appendByte('"')
+	case SyslogLevel:
+		enc.buf = strconv.AppendInt(enc.buf, int64(syslogSeverities[lvl]), 10)
+	default:
+		enc.appendByte('"')
+		enc.appendString(levelStrings[lvl])
+		enc.appendByte('"')
 	}
-	format := string(enc.buf)
-	format = fmt.Sprintf(format, args...)
-	return format
 }
 
 func (enc *jsonEncoder) AddBool(key string, value bool) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
+	enc.addKey(key)
 	enc.buf = strconv.AppendBool(enc.buf, value)
 }
 
 func (enc *jsonEncoder) AddInt(key string, value int) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
+	enc.addKey(key)
 	enc.buf = strconv.AppendInt(enc.buf, int64(value), 10)
 }
 
 func (enc *jsonEncoder) AddInt32(key string, value int32) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
+	enc.addKey(key)
 	enc.buf = strconv.AppendInt(enc.buf, int64(value), 10)
 }
 
 func (enc *jsonEncoder) AddUint32(key string, value uint32) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
+	enc.addKey(key)
 	enc.buf = strconv.AppendUint(enc.buf, uint64(value), 10)
 }
 
 func (enc *jsonEncoder) AddInt64(key string, value int64) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
+	enc.addKey(key)
 	enc.buf = strconv.AppendInt(enc.buf, value, 10)
 }
 
 func (enc *jsonEncoder) AddUint64(key string, value uint64) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
+	enc.addKey(key)
 	enc.buf = strconv.AppendUint(enc.buf, value, 10)
 }
 
 func (enc *jsonEncoder) AddInt8(key string, value int8) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
+	enc.addKey(key)
 	enc.buf = strconv.AppendInt(enc.buf, int64(value), 10)
 }
 
-func (enc *jsonEncoder) AddUint8(key string, value int8) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
+func (enc *jsonEncoder) AddUint8(key string, value uint8) {
+	enc.addKey(key)
 	enc.buf = strconv.AppendUint(enc.buf, uint64(value), 10)
 }
 
 func (enc *jsonEncoder) AddFloat32(key string, value float32) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
-	enc.buf = strconv.AppendFloat(enc.buf, float64(value), 'f', -1, 32)
+	enc.addKey(key)
+	enc.appendFloat(float64(value), 32)
 }
 
 func (enc *jsonEncoder) AddFloat64(key string, value float64) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": `)
-	enc.buf = strconv.AppendFloat(enc.buf, value, 'f', -1, 64)
+	enc.addKey(key)
+	enc.appendFloat(value, 64)
+}
+
+// appendFloat appends value, or "NaN", "+Inf" or "-Inf" as a string, as JSON
+// has no numbers for them.
+func (enc *jsonEncoder) appendFloat(value float64, bitSize int) {
+	switch {
+	case math.IsNaN(value):
+		enc.buf = append(enc.buf, `"NaN"`...)
+	case math.IsInf(value, 1):
+		enc.buf = append(enc.buf, `"+Inf"`...)
+	case math.IsInf(value, -1):
+		enc.buf = append(enc.buf, `"-Inf"`...)
+	default:
+		enc.buf = strconv.AppendFloat(enc.buf, value, 'f', -1, bitSize)
+	}
 }
 
 func (enc *jsonEncoder) AddString(key, value string) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": "`)
+	enc.addKey(key)
+	enc.appendByte('"')
 	enc.safeAddString(value)
 	enc.appendByte('"')
 }
 
 func (enc *jsonEncoder) AddInterface(key string, value interface{}) {
-	enc.AppendLeft()
-	enc.safeAddString(key)
-	enc.appendString(`": "`)
-	enc.safeAddString(fmt.Sprintf("%v", value))
+	enc.addKey(key)
+	enc.appendReflected(value)
+}
+
+func (enc *jsonEncoder) AddStack(key string, frames []StackFrame) {
+	enc.addKey(key)
+	enc.appendByte('[')
+	for i, frame := range frames {
+		if i > 0 {
+			enc.appendByte(',')
+		}
+		enc.appendByte('"')
+		enc.safeAddString(frame.String())
+		enc.appendByte('"')
+	}
+	enc.appendByte(']')
+}
+
+func (enc *jsonEncoder) AddDuration(key string, value time.Duration) {
+	enc.addKey(key)
+	enc.appendQuoted(value.String())
+}
+
+// AddTime writes value in the TimeFormat of the encoder.
+func (enc *jsonEncoder) AddTime(key string, value time.Time) {
+	enc.addKey(key)
+	enc.addTime(value)
+}
+
+func (enc *jsonEncoder) AddBinary(key string, value []byte) {
+	enc.addKey(key)
+	enc.appendByte('"')
+	n := len(enc.buf)
+	enc.buf = append(enc.buf, make([]byte, base64.StdEncoding.EncodedLen(len(value)))...)
+	base64.StdEncoding.Encode(enc.buf[n:], value)
+	enc.appendByte('"')
+}
+
+func (enc *jsonEncoder) AddObject(key string, obj ObjectMarshaler) error {
+	enc.addKey(key)
+	return enc.appendObject(obj)
+}
+
+func (enc *jsonEncoder) AddArray(key string, arr ArrayMarshaler) error {
+	enc.addKey(key)
+	return enc.appendArray(arr)
+}
+
+func (enc *jsonEncoder) OpenNamespace(key string) {
+	enc.addKey(key)
+	enc.appendByte('{')
+	enc.left = true
+	enc.open++
+}
+
+// closeNamespaces ends the namespaces open in the object being written.
+func (enc *jsonEncoder) closeNamespaces() {
+	for ; enc.open > 0; enc.open-- {
+		enc.appendByte('}')
+		enc.left = false
+	}
+}
+
+func (enc *jsonEncoder) appendObject(obj ObjectMarshaler) error {
+	open := enc.open
+	enc.open = 0
+	enc.nested++
+	enc.appendByte('{')
+	enc.left = true
+	err := obj.MarshalLogObject(enc)
+	enc.closeNamespaces()
+	enc.appendByte('}')
+	enc.left = false
+	enc.nested--
+	enc.open = open
+	return err
+}
+
+func (enc *jsonEncoder) appendArray(arr ArrayMarshaler) error {
+	enc.nested++
+	enc.appendByte('[')
+	err := arr.MarshalLogArray(enc)
+	enc.appendByte(']')
+	enc.nested--
+	return err
+}
+
+// appendReflected writes value as JSON.  Errors, and values that have no JSON
+// form, are written as strings of their text.
+func (enc *jsonEncoder) appendReflected(value interface{}) {
+	if err, ok := value.(error); ok {
+		enc.appendQuoted(err.Error())
+		return
+	}
+	var b bytes.Buffer
+	je := json.NewEncoder(&b)
+	je.SetEscapeHTML(false)
+	if err := je.Encode(value); err != nil {
+		enc.appendQuoted(fmt.Sprintf("%v", value))
+		return
+	}
+	enc.buf = append(enc.buf, bytes.TrimRight(b.Bytes(), "\n")...)
+}
+
+// reflectedText is the text the text encoders write for values with no type
+// of field of their own: the text of errors and Stringers, and JSON otherwise.
+func reflectedText(value interface{}) string {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	enc := getJsonEncoder()
+	defer putJsonEncoder(enc)
+	enc.appendReflected(value)
+	return string(enc.buf)
+}
+
+// appendElement separates an element of an array from the one before it.
+func (enc *jsonEncoder) appendElement() {
+	if n := len(enc.buf); n > 0 && enc.buf[n-1] != '[' {
+		enc.appendByte(',')
+	}
+}
+
+func (enc *jsonEncoder) AppendBool(value bool) {
+	enc.appendElement()
+	enc.buf = strconv.AppendBool(enc.buf, value)
+}
+
+func (enc *jsonEncoder) AppendInt64(value int64) {
+	enc.appendElement()
+	enc.buf = strconv.AppendInt(enc.buf, value, 10)
+}
+
+func (enc *jsonEncoder) AppendUint64(value uint64) {
+	enc.appendElement()
+	enc.buf = strconv.AppendUint(enc.buf, value, 10)
+}
+
+func (enc *jsonEncoder) AppendFloat32(value float32) {
+	enc.appendElement()
+	enc.appendFloat(float64(value), 32)
+}
+
+func (enc *jsonEncoder) AppendFloat64(value float64) {
+	enc.appendElement()
+	enc.appendFloat(value, 64)
+}
+
+func (enc *jsonEncoder) AppendString(value string) {
+	enc.appendElement()
+	enc.appendQuoted(value)
+}
+
+func (enc *jsonEncoder) AppendInterface(value interface{}) {
+	enc.appendElement()
+	enc.appendReflected(value)
+}
+
+func (enc *jsonEncoder) AppendObject(obj ObjectMarshaler) error {
+	enc.appendElement()
+	return enc.appendObject(obj)
+}
+
+func (enc *jsonEncoder) AppendArray(arr ArrayMarshaler) error {
+	enc.appendElement()
+	return enc.appendArray(arr)
+}
+
+func (enc *jsonEncoder) appendQuoted(s string) {
+	enc.appendByte('"')
+	enc.safeAddString(s)
 	enc.appendByte('"')
 }
 
@@ -0,0 +1,94 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// A filterLevel is how LevelHandler shows the level of a filter.
+type filterLevel struct {
+	Name  string `json:"name"`
+	Level string `json:"level"`
+}
+
+// LevelHandler returns an http.Handler to look at and change the levels of the
+// filters of log while it is running.
+//
+// GET lists the filters in dispatch order:
+//
+//	[{"name":"stdout","level":"INFO"},{"name":"file","level":"DEBUG"}]
+//
+// PUT takes a list of the same form and sets the level of each filter in it;
+// filters not in the list are left alone.  It answers like GET.
+func (log Logger) LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+		case "PUT":
+			var levels []filterLevel
+			if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+				http.Error(w, fmt.Sprintf("LevelHandler: %s", err), http.StatusBadRequest)
+				return
+			}
+			for _, fl := range levels {
+				if _, ok := strToLevel(fl.Level); !ok {
+					http.Error(w, fmt.Sprintf("LevelHandler: unknown level %q for filter %q", fl.Level, fl.Name), http.StatusBadRequest)
+					return
+				}
+				if _, ok := log.FilterLevel(fl.Name); !ok {
+					http.Error(w, fmt.Sprintf("LevelHandler: unknown filter %q", fl.Name), http.StatusNotFound)
+					return
+				}
+			}
+			for _, fl := range levels {
+				lvl, _ := strToLevel(fl.Level)
+				log.SetFilterLevel(fl.Name, lvl)
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			http.Error(w, "LevelHandler: method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		names, lvls := log.state().levels()
+		levels := make([]filterLevel, len(names))
+		for i, name := range names {
+			levels[i] = filterLevel{Name: name, Level: levelName(lvls[i])}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(levels)
+	})
+}
+
+// levelName returns the full name of lvl, as used in the XML configuration.
+func levelName(lvl Level) string {
+	if lvl < 0 || int(lvl) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(lvl))
+	}
+	return levelNames[lvl]
+}
+
+// stepLevels moves the levels of the named filters, or of all filters if none
+// are named, by step, keeping them from FINEST to CRITICAL.
+func (log Logger) stepLevels(step Level, filters []string) {
+	if len(filters) == 0 {
+		filters, _ = log.state().levels()
+	}
+	for _, name := range filters {
+		lvl, ok := log.FilterLevel(name)
+		if !ok {
+			continue
+		}
+		lvl += step
+		if lvl < FINEST {
+			lvl = FINEST
+		}
+		if lvl > CRITICAL {
+			lvl = CRITICAL
+		}
+		log.SetFilterLevel(name, lvl)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log4go
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleLevelSignals changes the levels of the named filters of log, or of all
+// of its filters if none are named, when the process receives a signal:
+// SIGUSR1 makes them one level more verbose (down to FINEST) and SIGUSR2 one
+// level less verbose (up to CRITICAL).  Call the returned function to stop.
+func (log Logger) HandleLevelSignals(filters ...string) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigs:
+				step := Level(1)
+				if sig == syscall.SIGUSR1 {
+					step = -1
+				}
+				log.stepLevels(step, filters)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package log4go
+
+// HandleLevelSignals does nothing on systems without SIGUSR1 and SIGUSR2.
+func (log Logger) HandleLevelSignals(filters ...string) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,34 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log4go
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLevelSignals(t *testing.T) {
+	l := make(Logger).AddFilter("stdout", INFO, &recordWriter{}).AddFilter("file", INFO, &recordWriter{})
+	defer l.Close()
+	stop := l.HandleLevelSignals("stdout")
+	defer stop()
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	for i := 0; i < 100; i++ {
+		if lvl, _ := l.FilterLevel("stdout"); lvl == TRACE {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if lvl, _ := l.FilterLevel("stdout"); lvl != TRACE {
+		t.Errorf("after SIGUSR1 stdout is at %v, want %v", lvl, TRACE)
+	}
+	if lvl, _ := l.FilterLevel("file"); lvl != INFO {
+		t.Errorf("after SIGUSR1 file is at %v, want %v", lvl, INFO)
+	}
+}
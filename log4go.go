@@ -39,17 +39,19 @@
 // Future work: (please let me know if you think I should work on any of these particularly)
 // - Log file rotation
 // - Logging configuration files ala log4j
-// - Have the ability to remove filters?
 // - Have GetInfoChannel, GetDebugChannel, etc return a chan string that allows
 //   for another method of logging
 // - Add an XML filter type
 package log4go
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -80,6 +82,7 @@ const (
 // Logging level strings
 var (
 	levelStrings = [...]string{"FNST", "FINE", "DEBG", "TRAC", "INFO", "WARN", "EROR", "CRIT"}
+	levelNames   = [...]string{"FINEST", "FINE", "DEBUG", "TRACE", "INFO", "WARNING", "ERROR", "CRITICAL"}
 )
 
 func (l Level) String() string {
@@ -91,14 +94,43 @@ func (l Level) String() string {
 
 /****** Variables ******/
 var (
-	// LogBufferLength specifies how many log messages a particular log4go
-	// logger can buffer at a time before writing them.
+	// LogBufferLength specifies how many log messages a LogWriter created
+	// from now on can buffer at a time before writing them, unless its
+	// SetBufferSize is called.
 	LogBufferLength = 32
 	LogRecordPool   = sync.Pool{New: func() interface{} {
 		return newLogRecord()
 	}}
+
+	// ExitCode is the status that Fatal exits the program with.
+	ExitCode = 1
+	exit     = os.Exit
+
+	// FatalShutdownTimeout limits how long Fatal waits for the writers to
+	// write the records passed to them before it exits anyway.
+	FatalShutdownTimeout = 10 * time.Second
+
+	exitHooksMu sync.Mutex
+	exitHooks   []func()
 )
 
+// RegisterExitHook adds hook to the functions that Fatal runs before it
+// closes the log writers and exits, in the order in which they were added.
+func RegisterExitHook(hook func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, hook)
+}
+
+func runExitHooks() {
+	exitHooksMu.Lock()
+	hooks := exitHooks
+	exitHooksMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
 /****** LogRecord ******/
 
 // A LogRecord contains all of the pertinent information for each message
@@ -109,12 +141,30 @@ type LogRecord struct {
 	Message string    // The log message
 	Json    bool      // The log type (true: Format, false: json)
 	Fields  []Field   // The json log field
+	Name    string    // The name of the logger (see GetLogger)
+	Func    string    // The function the message was logged from
+
+	refs  int32           // references to a pooled record, accessed atomically
+	kept  int32           // whether a writer may keep it, accessed atomically
+	flush chan error      // set on the records queued by newFlushRecord
+	next  chan *LogRecord // set on the record that ends a resized buffer
+}
+
+// newFlushRecord returns a record to queue behind the records of a LogWriter
+// that writes from a goroutine of its own.  When the goroutine reaches it, it
+// sends the error of the records before it, if any, on the record's flush
+// channel instead of writing it.  The channel is buffered, so the goroutine
+// never waits for a caller that gave up.
+func newFlushRecord() *LogRecord {
+	return &LogRecord{flush: make(chan error, 1)}
 }
 
 func newLogRecord() *LogRecord {
 	return &LogRecord{}
 }
 
+// GetLogRecord returns a record from LogRecordPool holding one reference,
+// which the caller gives up with Release.
 func GetLogRecord(lv Level, score, message string, json bool, field []Field) *LogRecord {
 	rec := LogRecordPool.Get().(*LogRecord)
 	rec.Level = lv
@@ -123,9 +173,12 @@ func GetLogRecord(lv Level, score, message string, json bool, field []Field) *Lo
 	rec.Message = message
 	rec.Json = json
 	rec.Fields = field
+	rec.refs = 1
 	return rec
 }
 
+// PutLogRecord clears rec and puts it back in LogRecordPool.  Records that may
+// still be referenced should be given up with Release instead.
 func PutLogRecord(rec *LogRecord) {
 	rec.Level = FINEST
 	rec.Created = time.Time{}
@@ -133,14 +186,38 @@ func PutLogRecord(rec *LogRecord) {
 	rec.Message = ""
 	rec.Json = false
 	rec.Fields = nil
+	rec.Name = ""
+	rec.Func = ""
+	rec.refs = 0
+	rec.kept = 0
 	LogRecordPool.Put(rec)
 }
 
+// Release gives up a reference to rec.  A record from GetLogRecord goes back
+// to LogRecordPool once the logging method that made it and every
+// RecordReleaser it was passed to have released it, unless it was also passed
+// to a LogWriter that is not a RecordReleaser.  Releasing other records does
+// nothing.
+func (rec *LogRecord) Release() {
+	if atomic.AddInt32(&rec.refs, -1) == 0 && atomic.LoadInt32(&rec.kept) == 0 {
+		PutLogRecord(rec)
+	}
+}
+
+// clone returns a copy of rec from LogRecordPool.  The fields are shared.
+func (rec *LogRecord) clone() *LogRecord {
+	dup := GetLogRecord(rec.Level, rec.Source, rec.Message, rec.Json, rec.Fields)
+	dup.Created, dup.Name, dup.Func = rec.Created, rec.Name, rec.Func
+	return dup
+}
+
 /****** LogWriter ******/
 
 // This is an interface for anything that should be able to write logs
 type LogWriter interface {
-	// This will be called to log a LogRecord message.
+	// This will be called to log a LogRecord message.  The record is shared
+	// with the other filters, so it must not be changed; writers that write
+	// from a goroutine of their own encode it there.
 	LogWrite(rec *LogRecord)
 
 	// This should clean up anything lingering about the LogWriter, as it is called before
@@ -148,17 +225,72 @@ type LogWriter interface {
 	Close()
 }
 
+// A RecordReleaser is a LogWriter that calls Release on every record passed to
+// its LogWrite once it has finished with it, if ReleasesRecords returns true.
+// Records passed to other LogWriters are never reused, so they may keep them.
+type RecordReleaser interface {
+	ReleasesRecords() bool
+}
+
+// A Flusher is a LogWriter that can wait until the records passed to it have
+// been written.  Flush blocks until then and returns the error that kept any
+// of them from being written.  The Flushers of this package return an error
+// from a Flush after or during Close.
+type Flusher interface {
+	Flush() error
+}
+
+// flushWriter flushes w if it is a Flusher.
+func flushWriter(w LogWriter) error {
+	if f, ok := w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// A DrainError maps the names of the filters whose writers failed to write
+// every record passed to them to the reason.
+type DrainError map[string]error
+
+func (e DrainError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e[name])
+	}
+	return "log4go: writers failed to drain: " + strings.Join(msgs, "; ")
+}
+
 /****** Logger ******/
 
 // A Filter represents the log level below which no log records are written to
-// the associated LogWriter.
+// the associated LogWriter.  If Matcher is not nil, only the records it
+// matches are written.
 type Filter struct {
 	Level Level
 	LogWriter
+	Matcher Matcher
 }
 
 // A Logger represents a collection of Filters through which log messages are
-// written.
+// written.  Filters receive records in the order in which they were added.
+//
+// A Logger may be changed with AddFilter, RemoveFilter, ReplaceFilter and
+// SetFilterLevel while other goroutines are logging through it.
+//
+// A Logger is still a map holding its filters, which the methods keep up to
+// date, but the logging methods dispatch from a copy made the first time the
+// Logger is used.  Filters stored into the map or deleted from it directly
+// after that are picked up by the next change made through the methods.
+// Indexing or ranging over the map is only safe while no other goroutine
+// changes the Logger; Filter and FilterLevel always are.  The first change to
+// a Logger made with make, or to one that Close has forgotten (see Close),
+// must not race with other uses of it; the other constructors, Global and
+// GetLogger return Loggers that are ready to share.
 type Logger map[string]*Filter
 
 // Create a new logger.
@@ -175,61 +307,433 @@ func NewLogger() Logger {
 // DEPRECATED: use NewDefaultLogger instead.
 func NewConsoleLogger(lvl Level) Logger {
 	os.Stderr.WriteString("warning: use of deprecated NewConsoleLogger\n")
-	return Logger{
-		"stdout": &Filter{lvl, NewConsoleLogWriter()},
-	}
+	return make(Logger).AddFilter("stdout", lvl, NewConsoleLogWriter())
 }
 
 // Create a new logger with a "stdout" filter configured to send log messages at
 // or above lvl to standard output.
 func NewDefaultLogger(lvl Level) Logger {
-	return Logger{
-		"stdout": &Filter{lvl, NewConsoleLogWriter()},
-	}
+	return make(Logger).AddFilter("stdout", lvl, NewConsoleLogWriter())
 }
 
 // Closes all log writers in preparation for exiting the program or a
 // reconfiguration of logging.  Calling this is not really imperative, unless
 // you want to guarantee that all log messages are written.  Close removes
-// all filters (and thus all LogWriters) from the logger.
+// all filters (and thus all LogWriters) from the logger; its levels, hooks,
+// Redactor and other settings are kept for the filters added after.  A Logger
+// without settings, other than Global, is forgotten so that it can be garbage
+// collected, and is set up again by the next change made to it.
 func (log Logger) Close() {
+	s, _ := log.resolve()
+	if s == nil {
+		return
+	}
+
+	_, filters := s.detach()
+
 	// Close all open loggers
-	for name, filt := range log {
+	for _, filt := range filters {
 		filt.Close()
-		delete(log, name)
 	}
 }
 
+// Flush blocks until the writers of log that are Flushers have written every
+// record passed to them, and so do those of the ancestors that the records of
+// a named logger go on to.  If any failed, the error is a DrainError.
+func (log Logger) Flush() error {
+	s, _ := log.resolve()
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	names, filters := s.names, s.filters
+	s.mu.RUnlock()
+	ancNames, ancFilters := s.ancestorFilters()
+	names = append(names[:len(names):len(names)], ancNames...)
+	filters = append(filters[:len(filters):len(filters)], ancFilters...)
+	return drain(context.Background(), names, filters, false)
+}
+
+// Shutdown is like Close, but waits for the writers of log that are Flushers
+// to write every record passed to them, or for ctx to be done, first.  The
+// writers of the ancestors that the records of a named logger go on to are
+// flushed as well, but not closed.  If any writer failed or had not finished
+// when ctx was done, the error is a DrainError.  Writers that have not
+// finished are left to close on their own.
+func (log Logger) Shutdown(ctx context.Context) error {
+	s, _ := log.resolve()
+	if s == nil {
+		return nil
+	}
+
+	names, filters := s.detach()
+	err := drain(ctx, names, filters, true)
+	ancNames, ancFilters := s.ancestorFilters()
+	if ancErr := drain(ctx, ancNames, ancFilters, false); ancErr != nil {
+		errs, _ := err.(DrainError)
+		if errs == nil {
+			errs = make(DrainError)
+		}
+		for name, e := range ancErr.(DrainError) {
+			errs[name] = e
+		}
+		err = errs
+	}
+	return err
+}
+
+// Health returns the Health of the writers of log that are HealthReporters,
+// by filter name.
+func (log Logger) Health() map[string]Health {
+	s, _ := log.resolve()
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	health := make(map[string]Health)
+	for i, filt := range s.filters {
+		if h, ok := writerHealthOf(filt.LogWriter); ok {
+			health[s.names[i]] = h
+		}
+	}
+	return health
+}
+
+// drain flushes, and closes if closing is set, the writers of filters at the
+// same time, until they are done or ctx is.
+func drain(ctx context.Context, names []string, filters []*Filter, closing bool) error {
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result, len(filters))
+	for i, filt := range filters {
+		go func(i int, w LogWriter) {
+			err := flushWriter(w)
+			if closing {
+				w.Close()
+			}
+			results <- result{i, err}
+		}(i, filt.LogWriter)
+	}
+
+	errs := make(DrainError)
+	done := make([]bool, len(filters))
+	for n := 0; n < len(filters); n++ {
+		select {
+		case r := <-results:
+			done[r.i] = true
+			if r.err != nil {
+				errs[names[r.i]] = r.err
+			}
+		case <-ctx.Done():
+			for i := range filters {
+				if !done[i] {
+					errs[names[i]] = ctx.Err()
+				}
+			}
+			return errs
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+var (
+	namedLoggersMu sync.Mutex
+	namedLoggers   = make(map[string]Logger)
+)
+
+// GetLogger returns the logger with the given name, creating it if needed.
+// Names are dot-separated paths: "db" is the parent of "db.pool", and the
+// root logger, Global, is the parent of "db".  The empty name is Global.
+//
+// A named logger starts without filters of its own.  Its records are written
+// to its own filters and then to those of its ancestors, unless additivity is
+// turned off (see SetAdditivity).  Its level is inherited from the nearest
+// ancestor that has one set (see SetLevel).
+func GetLogger(name string) Logger {
+	if name == "" {
+		return Global
+	}
+
+	namedLoggersMu.Lock()
+	defer namedLoggersMu.Unlock()
+	return getLogger(name)
+}
+
+// getLogger must be called with namedLoggersMu held.
+func getLogger(name string) Logger {
+	if log, ok := namedLoggers[name]; ok {
+		return log
+	}
+
+	log := make(Logger)
+	s := newLoggerState(log)
+	s.name = name
+	if i := strings.LastIndex(name, "."); i > 0 {
+		s.parent = getLogger(name[:i])
+	}
+	loggerStates.Store(log.key(), s)
+	namedLoggers[name] = log
+	return log
+}
+
+// Name returns the name log was created with by GetLogger, or "" for any
+// other logger.
+func (log Logger) Name() string {
+	if s, _ := log.resolve(); s != nil {
+		return s.name
+	}
+	return ""
+}
+
+// SetLevel sets the level below which records logged through log are dropped,
+// before any filter sees them.  Named loggers without a level of their own
+// inherit that of their nearest ancestor.
+// Returns the logger for chaining.
+func (log Logger) SetLevel(lvl Level) Logger {
+	s := log.lockState()
+	defer s.mu.Unlock()
+	atomic.StoreInt32(&s.level, int32(lvl))
+	return log
+}
+
+// InheritLevel clears the level set by SetLevel, so that log inherits the
+// level of its nearest ancestor again.
+// Returns the logger for chaining.
+func (log Logger) InheritLevel() Logger {
+	s := log.lockState()
+	defer s.mu.Unlock()
+	atomic.StoreInt32(&s.level, inheritLevel)
+	return log
+}
+
+// SetAdditivity sets whether records logged through a named logger are also
+// written to the filters of its ancestors, which is the default.  Turning it
+// off for "db" keeps the records of "db" and all of its descendants away from
+// the root logger.
+// Returns the logger for chaining.
+func (log Logger) SetAdditivity(additive bool) Logger {
+	var v int32
+	if additive {
+		v = 1
+	}
+	s := log.lockState()
+	defer s.mu.Unlock()
+	atomic.StoreInt32(&s.additive, v)
+	return log
+}
+
 // Add a new LogWriter to the Logger which will only log messages at lvl or
-// higher.  This function should not be called from multiple goroutines.
+// higher.  A filter already registered under name is replaced in place, but
+// its LogWriter is not closed; see ReplaceFilter.
 // Returns the logger for chaining.
 func (log Logger) AddFilter(name string, lvl Level, writer LogWriter) Logger {
-	log[name] = &Filter{lvl, writer}
+	s := log.lockState()
+	s.set(name, &Filter{Level: lvl, LogWriter: writer})
+	s.mu.Unlock()
+	return log
+}
+
+// AddMatchFilter works like AddFilter, but only writes the records at lvl or
+// higher that m matches.  For example, to write only ERROR and above from the
+// files of package db:
+//
+//	log.AddMatchFilter("db", ERROR, MatchSource(regexp.MustCompile(`/db/[^/]*\.go:`)), w)
+//
+// Returns the logger for chaining.
+func (log Logger) AddMatchFilter(name string, lvl Level, m Matcher, writer LogWriter) Logger {
+	s := log.lockState()
+	s.set(name, &Filter{Level: lvl, LogWriter: writer, Matcher: m})
+	s.mu.Unlock()
+	return log
+}
+
+// RemoveFilter removes the named filter and closes its LogWriter once no
+// record is being dispatched to it.  It reports whether the filter existed.
+func (log Logger) RemoveFilter(name string) bool {
+	s := log.lockState()
+	old := s.remove(name)
+	s.mu.Unlock()
+
+	if old == nil {
+		return false
+	}
+	old.Close()
+	return true
+}
+
+// ReplaceFilter works like AddFilter, but closes the LogWriter it replaces
+// once no record is being dispatched to it.
+// Returns the logger for chaining.
+func (log Logger) ReplaceFilter(name string, lvl Level, writer LogWriter) Logger {
+	s := log.lockState()
+	old := s.set(name, &Filter{Level: lvl, LogWriter: writer})
+	s.mu.Unlock()
+
+	if old != nil && old.LogWriter != writer {
+		old.Close()
+	}
+	return log
+}
+
+// SetFilterLevel changes the level of the named filter.  A level above
+// CRITICAL pauses the filter without removing it.  It reports whether the
+// filter existed.
+func (log Logger) SetFilterLevel(name string, lvl Level) bool {
+	s := log.lockState()
+	defer s.mu.Unlock()
+
+	i := s.index(name)
+	if i < 0 {
+		return false
+	}
+	// Filters returned by Filter are never changed.
+	filt := *s.filters[i]
+	filt.Level = lvl
+	s.filters[i] = &filt
+	s.log[name] = &filt
+	s.update()
+	return true
+}
+
+// WithCallerSkip returns a Logger that skips n more stack frames to find the
+// source of its records, for use by helpers that wrap log.  The returned
+// Logger shares the filters of log, like one returned by With.
+func (log Logger) WithCallerSkip(n int) Logger {
+	base, d := log, (*derivedLogger)(nil)
+	if _, d = log.resolve(); d != nil {
+		base = d.base
+	}
+	return Logger{
+		derivedKey: &Filter{Level: FINEST, LogWriter: &derivedLogger{base: base, fields: d.with(nil), skip: d.callerSkip() + n}},
+	}
+}
+
+// SetStackLevel makes log add the stack of the caller, as a field named
+// "stacktrace", to every record at or above lvl.  Named loggers without a
+// stack level of their own use that of their nearest ancestor.
+// Returns the logger for chaining.
+func (log Logger) SetStackLevel(lvl Level) Logger {
+	s := log.lockState()
+	defer s.mu.Unlock()
+	atomic.StoreInt32(&s.stack, int32(lvl))
+	return log
+}
+
+// SetCallerTrim sets the prefixes removed from the file names of the sources
+// of records, such as the GOPATH src directory or the root of a module; only
+// the first prefix that matches is removed.  Named loggers without prefixes
+// of their own use those of their nearest ancestor.
+// Returns the logger for chaining.
+func (log Logger) SetCallerTrim(prefixes ...string) Logger {
+	s := log.lockState()
+	defer s.mu.Unlock()
+	s.trim.Store(append([]string(nil), prefixes...))
+	return log
+}
+
+// With returns a Logger that adds fields to every record it logs, after any
+// fields log already adds.  The returned Logger shares the filters of log:
+// changing or closing the filters of either changes both.
+func (log Logger) With(fields ...Field) Logger {
+	base, d := log, (*derivedLogger)(nil)
+	if _, d = log.resolve(); d != nil {
+		base = d.base
+	}
+	bound := d.with(snapshotFields(fields))
+	return Logger{
+		derivedKey: &Filter{Level: FINEST, LogWriter: &derivedLogger{base: base, fields: bound, skip: d.callerSkip()}},
+	}
+}
+
+// Filter returns the named filter, or nil if there is none.  The filter must
+// not be changed; use SetFilterLevel, ReplaceFilter or RemoveFilter.
+func (log Logger) Filter(name string) *Filter {
+	s, _ := log.resolve()
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i := s.index(name); i >= 0 {
+		return s.filters[i]
+	}
+	return nil
+}
+
+// FilterLevel returns the level of the named filter, and whether it exists.
+func (log Logger) FilterLevel(name string) (Level, bool) {
+	s, _ := log.resolve()
+	if s == nil {
+		return 0, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.index(name)
+	if i < 0 {
+		return 0, false
+	}
+	return s.filters[i].Level, true
+}
+
+// A Hook is run on every record logged through a Logger, after the level
+// check and before the record is written.  It may change the record, such as
+// to add fields or rewrite the message, and returns false to drop it.  It must
+// not keep the record, which is reused once it has been written.  A record a
+// hook adds fields to is written as a structured one, as if it had been logged
+// with them.
+type Hook func(rec *LogRecord) (keep bool)
+
+// AddHook adds hook to the hooks of log, which run in the order in which they
+// were added.  The hooks of a named logger run before those of its
+// ancestors, and a Logger returned by With shares the hooks of its parent.
+// Records logged through a Logger with hooks always have their source and
+// function, for the hooks to look at.
+// Returns the logger for chaining.
+func (log Logger) AddHook(hook Hook) Logger {
+	s := log.lockState()
+	defer s.mu.Unlock()
+	old, _ := s.hooks.Load().([]Hook)
+	s.hooks.Store(append(old[:len(old):len(old)], hook))
+	return log
+}
+
+// SetRedactor makes log hide what the rules of r match in every record, after
+// the hooks have run and before any writer encodes it; nil removes the
+// Redactor.  Records logged through named loggers pass through the Redactors
+// of their ancestors as well.  Returns the logger for chaining.
+func (log Logger) SetRedactor(r *Redactor) Logger {
+	s := log.lockState()
+	defer s.mu.Unlock()
+	s.redactor.Store(r)
 	return log
 }
 
+// Enabled reports whether a record at lvl would be written by any filter.  It
+// is cheap enough to guard expensive log arguments with.
+func (log Logger) Enabled(lvl Level) bool {
+	s, _ := log.resolve()
+	return s.enabled(lvl)
+}
+
 /******* Logging *******/
 // Send a formatted log message internally
 func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
-	skip := true
-
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	s, d := log.resolve()
+	if !s.enabled(lvl) {
 		return
 	}
 
 	// Determine caller func
-	_, fileName, lineno, ok := runtime.Caller(2)
-	src := ""
-	if ok {
-		src = fmt.Sprintf("%s:%d", fileName, lineno)
-	}
+	src, fn := s.caller(2 + d.callerSkip())
 
 	msg := format
 	if len(args) > 0 {
@@ -237,130 +741,106 @@ func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
 	}
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
-		Message: msg,
-	}
+	fields := d.with(nil)
+	rec := GetLogRecord(lvl, src, msg, len(fields) > 0, fields)
+	rec.Func, rec.Name = fn, s.name
+	s.addStack(rec, 2+d.callerSkip())
 
 	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
+	if s.runHooks(rec) {
+		s.dispatch(rec)
 	}
+	rec.Release()
 }
 
 func (log Logger) intLogJson(lvl Level, message string, filed ...Field) {
-	skip := true
-
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	s, d := log.resolve()
+	if !s.enabled(lvl) {
 		return
 	}
 
 	// Determine caller func
-	_, fileName, lineno, ok := runtime.Caller(2)
-	src := ""
-	if ok {
-		src = fmt.Sprintf("%s:%d", fileName, lineno)
+	src, fn := s.caller(2 + d.callerSkip())
+
+	// Make the log record
+	rec := GetLogRecord(lvl, src, message, true, d.with(snapshotFields(filed)))
+	rec.Func, rec.Name = fn, s.name
+	s.addStack(rec, 2+d.callerSkip())
+
+	// Dispatch the logs
+	if s.runHooks(rec) {
+		s.dispatch(rec)
+	}
+	rec.Release()
+}
+
+// Send a structured log message with the fields found in ctx internally
+func (log Logger) intLogCtx(ctx context.Context, lvl Level, message string, filed ...Field) {
+	// Determine if any logging will be done
+	s, d := log.resolve()
+	if !s.enabled(lvl) {
+		return
 	}
-	now := time.Now()
+
+	// Determine caller func
+	src, fn := s.caller(2 + d.callerSkip())
+
+	// Make the log record
+	rec := GetLogRecord(lvl, src, message, true, d.with(snapshotFields(withContext(ctx, filed))))
+	rec.Func, rec.Name = fn, s.name
+	s.addStack(rec, 2+d.callerSkip())
+
 	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		// Make the log record
-		rec := &LogRecord{
-			Level:   lvl,
-			Created: now,
-			Source:  src,
-			Message: message,
-			Json:    true,
-			Fields:  filed,
-		}
-		filt.LogWrite(rec)
+	if s.runHooks(rec) {
+		s.dispatch(rec)
 	}
+	rec.Release()
 }
 
 // Send a closure log message internally
 func (log Logger) intLogc(lvl Level, closure func() string) {
-	skip := true
-
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	s, d := log.resolve()
+	if !s.enabled(lvl) {
 		return
 	}
 
 	// Determine caller func
-	_, fileName, lineno, ok := runtime.Caller(2)
-	src := ""
-	if ok {
-		src = fmt.Sprintf("%s:%d", fileName, lineno)
-	}
+	src, fn := s.caller(2 + d.callerSkip())
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
-		Message: closure(),
-	}
+	fields := d.with(nil)
+	rec := GetLogRecord(lvl, src, closure(), len(fields) > 0, fields)
+	rec.Func, rec.Name = fn, s.name
+	s.addStack(rec, 2+d.callerSkip())
 
 	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
+	if s.runHooks(rec) {
+		s.dispatch(rec)
 	}
+	rec.Release()
 }
 
 // Send a log message with manual level, source, and message.
 func (log Logger) Log(lvl Level, source, message string) {
-	skip := true
-
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	s, d := log.resolve()
+	if !s.enabled(lvl) {
 		return
 	}
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  source,
-		Message: message,
-	}
+	fields := d.with(nil)
+	rec := GetLogRecord(lvl, source, message, len(fields) > 0, fields)
+	rec.Name = s.name
+	s.addStack(rec, 1)
 
 	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
+	if s.runHooks(rec) {
+		s.dispatch(rec)
 	}
+	rec.Release()
 }
 
 // Logf logs a formatted log message at the given log level, using the caller as
@@ -462,6 +942,27 @@ func (log Logger) Criticalf(arg0 string, args ...interface{}) {
 	log.intLogf(lvl, fmt.Sprintf(arg0, args...))
 }
 
+// Finest logs a message and fields at the finest log level.
+// See Debug for an explanation of the arguments.
+func (log Logger) Finest(message string, field ...Field) {
+	const (
+		lvl = FINEST
+	)
+	log.intLogJson(lvl, message, field...)
+}
+
+// Fine logs a message and fields at the fine log level.
+// See Debug for an explanation of the arguments.
+func (log Logger) Fine(message string, field ...Field) {
+	const (
+		lvl = FINE
+	)
+	log.intLogJson(lvl, message, field...)
+}
+
+// Debug logs a message and structured fields at the debug log level.  Fields
+// are written as JSON by the FileLogWriter and as key:value text by the
+// ConsoleLogWriter.
 func (log Logger) Debug(message string, field ...Field) {
 	const (
 		lvl = DEBUG
@@ -469,6 +970,17 @@ func (log Logger) Debug(message string, field ...Field) {
 	log.intLogJson(lvl, message, field...)
 }
 
+// Trace logs a message and fields at the trace log level.
+// See Debug for an explanation of the arguments.
+func (log Logger) Trace(message string, field ...Field) {
+	const (
+		lvl = TRACE
+	)
+	log.intLogJson(lvl, message, field...)
+}
+
+// Info logs a message and fields at the info log level.
+// See Debug for an explanation of the arguments.
 func (log Logger) Info(message string, field ...Field) {
 	const (
 		lvl = INFO
@@ -476,6 +988,8 @@ func (log Logger) Info(message string, field ...Field) {
 	log.intLogJson(lvl, message, field...)
 }
 
+// Warn logs a message and fields at the warning log level.
+// See Debug for an explanation of the arguments.
 func (log Logger) Warn(message string, field ...Field) {
 	const (
 		lvl = WARNING
@@ -483,9 +997,88 @@ func (log Logger) Warn(message string, field ...Field) {
 	log.intLogJson(lvl, message, field...)
 }
 
+// Error logs a message and fields at the error log level.
+// See Debug for an explanation of the arguments.
 func (log Logger) Error(message string, field ...Field) {
 	const (
 		lvl = ERROR
 	)
 	log.intLogJson(lvl, message, field...)
 }
+
+// Critical logs a message and fields at the critical log level.
+// See Debug for an explanation of the arguments.
+func (log Logger) Critical(message string, field ...Field) {
+	const (
+		lvl = CRITICAL
+	)
+	log.intLogJson(lvl, message, field...)
+}
+
+// Fatal logs a message and fields at the critical log level, runs the hooks
+// registered with RegisterExitHook, closes the log writers so that the message
+// is written, and exits the program with ExitCode.  The writers of the
+// ancestors of a named logger are flushed as well.  Writers that have not
+// finished within FatalShutdownTimeout are left behind.
+func (log Logger) Fatal(message string, field ...Field) {
+	const (
+		lvl = CRITICAL
+	)
+	log.intLogJson(lvl, message, field...)
+	log.exit()
+}
+
+// Panic logs a message and fields at the critical log level, flushes the log
+// writers so that the message is written, and panics with the message.  The
+// writers stay open for the code that recovers.
+func (log Logger) Panic(message string, field ...Field) {
+	const (
+		lvl = CRITICAL
+	)
+	log.intLogJson(lvl, message, field...)
+	log.Flush() // so that the messages get logged
+	panic(message)
+}
+
+// exit runs the exit hooks, shuts log down and exits the program with
+// ExitCode.
+func (log Logger) exit() {
+	runExitHooks()
+	ctx, cancel := context.WithTimeout(context.Background(), FatalShutdownTimeout)
+	log.Shutdown(ctx) // so that the messages get logged
+	cancel()
+	exit(ExitCode)
+}
+
+// DebugCtx is like Debug, but also logs the fields that the extractors
+// registered with RegisterContextExtractor find in ctx.
+func (log Logger) DebugCtx(ctx context.Context, message string, field ...Field) {
+	const (
+		lvl = DEBUG
+	)
+	log.intLogCtx(ctx, lvl, message, field...)
+}
+
+// InfoCtx is like Info; see DebugCtx.
+func (log Logger) InfoCtx(ctx context.Context, message string, field ...Field) {
+	const (
+		lvl = INFO
+	)
+	log.intLogCtx(ctx, lvl, message, field...)
+}
+
+// WarnCtx is like Warn; see DebugCtx.
+func (log Logger) WarnCtx(ctx context.Context, message string, field ...Field) {
+	const (
+		lvl = WARNING
+	)
+	log.intLogCtx(ctx, lvl, message, field...)
+}
+
+// ErrorCtx is like Error; see DebugCtx.
+func (log Logger) ErrorCtx(ctx context.Context, message string, field ...Field) {
+	const (
+		lvl = ERROR
+	)
+	log.intLogCtx(ctx, lvl, message, field...)
+}
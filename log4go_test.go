@@ -3,13 +3,26 @@
 package log4go
 
 import (
+	"bufio"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"regexp"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -89,26 +102,23 @@ var logRecordWriteTests = []struct {
 			Message: "message",
 			Created: now,
 		},
-		Console: "[23:31:30 UTC 2009/02/13] [CRIT] message\n",
+		Console: "[23:31:30 UTC 2009/02/13] [CRIT] (source) message\n",
 	},
 }
 
 func TestConsoleLogWriter(t *testing.T) {
-	console := make(ConsoleLogWriter)
-
-	r, w := io.Pipe()
-	go console.run(w)
+	var buf strings.Builder
+	console := NewConsoleLogWriter().SetOutputs(&buf, nil, FINEST)
 	defer console.Close()
 
-	buf := make([]byte, 1024)
-
 	for _, test := range logRecordWriteTests {
 		name := test.Test
 
+		buf.Reset()
 		console.LogWrite(test.Record)
-		n, _ := r.Read(buf)
+		console.Flush()
 
-		if got, want := string(buf[:n]), test.Console; got != want {
+		if got, want := buf.String(), test.Console; got != want {
 			t.Errorf("%s:  got %q", name, got)
 			t.Errorf("%s: want %q", name, want)
 		}
@@ -189,19 +199,22 @@ func TestLogger(t *testing.T) {
 		t.Fatalf("AddFilter produced invalid logger (incorrect map count)")
 	}
 
-	//func (l *Logger) Warn(format string, args ...interface{}) error {}
-	if err := l.Warn("%s %d %#v", "Warning:", 1, []int{}); err.Error() != "Warning: 1 []int{}" {
-		t.Errorf("Warn returned invalid error: %s", err)
-	}
-
-	//func (l *Logger) Error(format string, args ...interface{}) error {}
-	if err := l.Error("%s %d %#v", "Error:", 10, []string{}); err.Error() != "Error: 10 []string{}" {
-		t.Errorf("Error returned invalid error: %s", err)
-	}
+	l.Close()
 
-	//func (l *Logger) Critical(format string, args ...interface{}) error {}
-	if err := l.Critical("%s %d %#v", "Critical:", 100, []int64{}); err.Error() != "Critical: 100 []int64{}" {
-		t.Errorf("Critical returned invalid error: %s", err)
+	//func (l Logger) Warnf(format string, args ...interface{}) {}
+	//func (l Logger) Errorf(format string, args ...interface{}) {}
+	//func (l Logger) Criticalf(format string, args ...interface{}) {}
+	var buf strings.Builder
+	console := NewConsoleLogWriter().SetOutputs(&buf, nil, FINEST)
+	console.SetFormat("[%L] %M")
+	l = make(Logger).AddFilter("stdout", DEBUG, console)
+	l.Warnf("%s %d %#v", "Warning:", 1, []int{})
+	l.Errorf("%s %d %#v", "Error:", 10, []string{})
+	l.Criticalf("%s %d %#v", "Critical:", 100, []int64{})
+	l.Close()
+	want := "[WARN] Warning: 1 []int{}\n[EROR] Error: 10 []string{}\n[CRIT] Critical: 100 []int64{}\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Warnf, Errorf and Criticalf wrote %q, want %q", got, want)
 	}
 
 	// Already tested or basically untestable
@@ -237,11 +250,11 @@ func TestLogOutput(t *testing.T) {
 	l.Logf(ERROR, "This message is level %v", ERROR)
 	l.Logf(WARNING, "This message is level %s", WARNING)
 	l.Logc(INFO, func() string { return "This message is level INFO" })
-	l.Trace("This message is level %d", int(TRACE))
-	l.Debug("This message is level %s", DEBUG)
-	l.Fine(func() string { return fmt.Sprintf("This message is level %v", FINE) })
-	l.Finest("This message is level %v", FINEST)
-	l.Finest(FINEST, "is also this message's level")
+	l.Tracef("This message is level %d", int(TRACE))
+	l.Debugf("This message is level %s", DEBUG)
+	l.Logc(FINE, func() string { return fmt.Sprintf("This message is level %v", FINE) })
+	l.Finestf("This message is level %v", FINEST)
+	l.Finestf("%v is also this message's level", FINEST)
 
 	l.Close()
 
@@ -299,66 +312,81 @@ func TestCountMallocs(t *testing.T) {
 	}
 	mallocs += getMallocs()
 	fmt.Printf("mallocs per unlogged sl.Logf(WARNING, \"%%s is a log message with level %%d\", \"This\", WARNING): %d\n", mallocs/N)
+
+	// Records come from the pool, and are shared by writers that release
+	// them, so dispatch itself does not allocate.
+	pl := make(Logger).AddFilter("a", INFO, releaseWriter{}).AddFilter("b", INFO, releaseWriter{})
+	defer pl.Close()
+	if n := testing.AllocsPerRun(100, func() { pl.Log(WARNING, "here", "This is a log message") }); n >= 1 {
+		t.Errorf("mallocs per pooled Log: %v, want 0", n)
+	}
 }
 
+// releaseWriter discards records, releasing them.
+type releaseWriter struct{}
+
+func (releaseWriter) LogWrite(rec *LogRecord) { rec.Release() }
+func (releaseWriter) Close()                  {}
+func (releaseWriter) ReleasesRecords() bool   { return true }
+func (releaseWriter) NeedsCaller() bool       { return false }
+
 func TestXMLConfig(t *testing.T) {
 	const (
 		configfile = "example.xml"
 	)
 
-	fd, err := os.Create(configfile)
-	if err != nil {
-		t.Fatalf("Could not open %s for writing: %s", configfile, err)
-	}
-
-	fmt.Fprintln(fd, "<logging>")
-	fmt.Fprintln(fd, "  <filter enabled=\"true\">")
-	fmt.Fprintln(fd, "    <tag>stdout</tag>")
-	fmt.Fprintln(fd, "    <type>console</type>")
-	fmt.Fprintln(fd, "    <!-- level is (:?FINEST|FINE|DEBUG|TRACE|INFO|WARNING|ERROR) -->")
-	fmt.Fprintln(fd, "    <level>DEBUG</level>")
-	fmt.Fprintln(fd, "  </filter>")
-	fmt.Fprintln(fd, "  <filter enabled=\"true\">")
-	fmt.Fprintln(fd, "    <tag>file</tag>")
-	fmt.Fprintln(fd, "    <type>file</type>")
-	fmt.Fprintln(fd, "    <level>FINEST</level>")
-	fmt.Fprintln(fd, "    <property name=\"filename\">test.log</property>")
-	fmt.Fprintln(fd, "    <!--")
-	fmt.Fprintln(fd, "       %T - Time (15:04:05 MST)")
-	fmt.Fprintln(fd, "       %t - Time (15:04)")
-	fmt.Fprintln(fd, "       %D - Date (2006/01/02)")
-	fmt.Fprintln(fd, "       %d - Date (01/02/06)")
-	fmt.Fprintln(fd, "       %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)")
-	fmt.Fprintln(fd, "       %S - Source")
-	fmt.Fprintln(fd, "       %M - Message")
-	fmt.Fprintln(fd, "       It ignores unknown format strings (and removes them)")
-	fmt.Fprintln(fd, "       Recommended: \"[%D %T] [%L] (%S) %M\"")
-	fmt.Fprintln(fd, "    -->")
-	fmt.Fprintln(fd, "    <property name=\"format\">[%D %T] [%L] (%S) %M</property>")
-	fmt.Fprintln(fd, "    <property name=\"rotate\">false</property> <!-- true enables log rotation, otherwise append -->")
-	fmt.Fprintln(fd, "    <property name=\"maxsize\">0M</property> <!-- \\d+[KMG]? Suffixes are in terms of 2**10 -->")
-	fmt.Fprintln(fd, "    <property name=\"maxlines\">0K</property> <!-- \\d+[KMG]? Suffixes are in terms of thousands -->")
-	fmt.Fprintln(fd, "    <property name=\"daily\">true</property> <!-- Automatically rotates when a log message is written after midnight -->")
-	fmt.Fprintln(fd, "  </filter>")
-	fmt.Fprintln(fd, "  <filter enabled=\"true\">")
-	fmt.Fprintln(fd, "    <tag>xmllog</tag>")
-	fmt.Fprintln(fd, "    <type>xml</type>")
-	fmt.Fprintln(fd, "    <level>TRACE</level>")
-	fmt.Fprintln(fd, "    <property name=\"filename\">trace.xml</property>")
-	fmt.Fprintln(fd, "    <property name=\"rotate\">true</property> <!-- true enables log rotation, otherwise append -->")
-	fmt.Fprintln(fd, "    <property name=\"maxsize\">100M</property> <!-- \\d+[KMG]? Suffixes are in terms of 2**10 -->")
-	fmt.Fprintln(fd, "    <property name=\"maxrecords\">6K</property> <!-- \\d+[KMG]? Suffixes are in terms of thousands -->")
-	fmt.Fprintln(fd, "    <property name=\"daily\">false</property> <!-- Automatically rotates when a log message is written after midnight -->")
-	fmt.Fprintln(fd, "  </filter>")
-	fmt.Fprintln(fd, "  <filter enabled=\"false\"><!-- enabled=false means this logger won't actually be created -->")
-	fmt.Fprintln(fd, "    <tag>donotopen</tag>")
-	fmt.Fprintln(fd, "    <type>socket</type>")
-	fmt.Fprintln(fd, "    <level>FINEST</level>")
-	fmt.Fprintln(fd, "    <property name=\"endpoint\">192.168.1.255:12124</property> <!-- recommend UDP broadcast -->")
-	fmt.Fprintln(fd, "    <property name=\"protocol\">udp</property> <!-- tcp or udp -->")
-	fmt.Fprintln(fd, "  </filter>")
-	fmt.Fprintln(fd, "</logging>")
-	fd.Close()
+	config := `<logging>
+  <filter enabled="true">
+    <tag>stdout</tag>
+    <type>console</type>
+    <!-- level is (:?FINEST|FINE|DEBUG|TRACE|INFO|WARNING|ERROR) -->
+    <level>DEBUG</level>
+  </filter>
+  <filter enabled="true">
+    <tag>file</tag>
+    <type>file</type>
+    <level>FINEST</level>
+    <property name="filename">test.log</property>
+    <!--
+       %T - Time (15:04:05 MST)
+       %t - Time (15:04)
+       %D - Date (2006/01/02)
+       %d - Date (01/02/06)
+       %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)
+       %S - Source
+       %M - Message
+       It ignores unknown format strings (and removes them)
+       Recommended: "[%D %T] [%L] (%S) %M"
+    -->
+    <property name="format">[%D %T] [%L] (%S) %M</property>
+    <property name="rotate">false</property> <!-- true enables log rotation, otherwise append -->
+    <property name="maxsize">0M</property> <!-- \d+[KMG]? Suffixes are in terms of 2**10 -->
+    <property name="maxlines">0K</property> <!-- \d+[KMG]? Suffixes are in terms of thousands -->
+    <property name="daily">true</property> <!-- Automatically rotates when a log message is written after midnight -->
+  </filter>
+  <filter enabled="true">
+    <tag>xmllog</tag>
+    <type>xml</type>
+    <level>TRACE</level>
+    <property name="filename">trace.xml</property>
+    <property name="rotate">true</property> <!-- true enables log rotation, otherwise append -->
+    <property name="maxsize">100M</property> <!-- \d+[KMG]? Suffixes are in terms of 2**10 -->
+    <property name="maxrecords">6K</property> <!-- \d+[KMG]? Suffixes are in terms of thousands -->
+    <property name="daily">false</property> <!-- Automatically rotates when a log message is written after midnight -->
+  </filter>
+  <filter enabled="false"><!-- enabled=false means this logger won't actually be created -->
+    <tag>donotopen</tag>
+    <type>socket</type>
+    <level>FINEST</level>
+    <property name="endpoint">192.168.1.255:12124</property> <!-- recommend UDP broadcast -->
+    <property name="protocol">udp</property> <!-- tcp or udp -->
+  </filter>
+</logging>
+`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+	defer os.Remove(configfile)
 
 	log := make(Logger)
 	log.LoadConfiguration(configfile)
@@ -383,7 +411,7 @@ func TestXMLConfig(t *testing.T) {
 	}
 
 	// Make sure they're the right type
-	if _, ok := log["stdout"].LogWriter.(ConsoleLogWriter); !ok {
+	if _, ok := log["stdout"].LogWriter.(*ConsoleLogWriter); !ok {
 		t.Fatalf("XMLConfig: Expected stdout to be ConsoleLogWriter, found %T", log["stdout"].LogWriter)
 	}
 	if _, ok := log["file"].LogWriter.(*FileLogWriter); !ok {
@@ -413,9 +441,6 @@ func TestXMLConfig(t *testing.T) {
 	if fname := log["xmllog"].LogWriter.(*FileLogWriter).file.Name(); fname != "trace.xml" {
 		t.Errorf("XMLConfig: Expected xmllog to have opened %s, found %s", "trace.xml", fname)
 	}
-
-	// Move XML log file
-	os.Rename(configfile, "examples/"+configfile) // Keep this so that an example with the documentation is available
 }
 
 func BenchmarkFormatLogRecord(b *testing.B) {
@@ -464,14 +489,14 @@ func BenchmarkConsoleNotLogged(b *testing.B) {
 func BenchmarkConsoleUtilLog(b *testing.B) {
 	sl := NewDefaultLogger(INFO)
 	for i := 0; i < b.N; i++ {
-		sl.Info("%s is a log message", "This")
+		sl.Infof("%s is a log message", "This")
 	}
 }
 
 func BenchmarkConsoleUtilNotLog(b *testing.B) {
 	sl := NewDefaultLogger(INFO)
 	for i := 0; i < b.N; i++ {
-		sl.Debug("%s is a log message", "This")
+		sl.Debugf("%s is a log message", "This")
 	}
 }
 
@@ -505,7 +530,7 @@ func BenchmarkFileUtilLog(b *testing.B) {
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		sl.Info("%s is a log message", "This")
+		sl.Infof("%s is a log message", "This")
 	}
 	b.StopTimer()
 	os.Remove("benchlog.log")
@@ -517,7 +542,7 @@ func BenchmarkFileUtilNotLog(b *testing.B) {
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		sl.Debug("%s is a log message", "This")
+		sl.Debugf("%s is a log message", "This")
 	}
 	b.StopTimer()
 	os.Remove("benchlog.log")
@@ -532,3 +557,1538 @@ func BenchmarkFileUtilNotLog(b *testing.B) {
 //elog.BenchmarkFileNotLogged       2000000         821 ns/op
 //elog.BenchmarkFileUtilLog           50000       33945 ns/op
 //elog.BenchmarkFileUtilNotLog      1000000        1258 ns/op
+
+// recordWriter is a LogWriter that keeps what it is sent, for inspection.
+type recordWriter struct {
+	mu     sync.Mutex
+	name   string
+	order  *[]string
+	recs   []*LogRecord
+	closed bool
+}
+
+func (w *recordWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		panic("LogWrite after Close")
+	}
+	w.recs = append(w.recs, rec)
+	if w.order != nil {
+		*w.order = append(*w.order, w.name)
+	}
+}
+
+func (w *recordWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+}
+
+func (w *recordWriter) Records() []*LogRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*LogRecord(nil), w.recs...)
+}
+
+func TestLoggerFilters(t *testing.T) {
+	var order []string
+	l := make(Logger)
+	for _, name := range []string{"c", "a", "b"} {
+		l.AddFilter(name, INFO, &recordWriter{name: name, order: &order})
+	}
+
+	l.Log(INFO, "source", "message")
+	if got, want := fmt.Sprint(order), "[c a b]"; got != want {
+		t.Errorf("dispatch order = %s, want %s", got, want)
+	}
+
+	if l.Enabled(DEBUG) || !l.Enabled(INFO) {
+		t.Errorf("Enabled: DEBUG=%v INFO=%v, want false true", l.Enabled(DEBUG), l.Enabled(INFO))
+	}
+	if !l.SetFilterLevel("a", DEBUG) || !l.Enabled(DEBUG) {
+		t.Errorf("SetFilterLevel(a, DEBUG) did not enable DEBUG")
+	}
+	if l.Filter("a").Level != DEBUG {
+		t.Errorf("Filter(a).Level = %v, want %v", l.Filter("a").Level, DEBUG)
+	}
+
+	b := l.Filter("b").LogWriter.(*recordWriter)
+	if !l.RemoveFilter("b") || l.RemoveFilter("b") {
+		t.Errorf("RemoveFilter(b) should succeed exactly once")
+	}
+	if n := filterCount(l); !b.closed || n != 2 {
+		t.Errorf("RemoveFilter(b): closed=%v filters=%d, want true 2", b.closed, n)
+	}
+
+	c := l.Filter("c").LogWriter.(*recordWriter)
+	l.ReplaceFilter("c", INFO, &recordWriter{name: "c2", order: &order})
+	if !c.closed {
+		t.Errorf("ReplaceFilter(c) did not close the replaced writer")
+	}
+
+	order = nil
+	l.Log(INFO, "source", "message")
+	if got, want := fmt.Sprint(order), "[c2 a]"; got != want {
+		t.Errorf("dispatch order = %s, want %s", got, want)
+	}
+
+	l.Close()
+	if n := filterCount(l); n != 0 || l.Enabled(CRITICAL) {
+		t.Errorf("Close left %d filters, Enabled(CRITICAL)=%v", n, l.Enabled(CRITICAL))
+	}
+
+	// Filters stored into the map before it is used are taken over by it, and
+	// the map keeps holding the filters.
+	d, e, f := &recordWriter{}, &recordWriter{}, &recordWriter{}
+	l = make(Logger)
+	l["d"] = &Filter{Level: INFO, LogWriter: d}
+	l.Info("message")
+	if len(d.Records()) != 1 || l.Filter("d") == nil {
+		t.Errorf("filter stored into the map was not used")
+	}
+	l.AddFilter("e", INFO, e)
+	var names []string
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if got, want := fmt.Sprint(names), "[d e]"; got != want || l["e"].LogWriter != e {
+		t.Errorf("map holds %s, want %s", got, want)
+	}
+
+	// Filters stored into the map or deleted from it after that are picked up
+	// by the next change.
+	l["f"] = &Filter{Level: INFO, LogWriter: f}
+	delete(l, "d")
+	l.SetFilterLevel("e", INFO)
+	l.Info("message")
+	if len(d.Records()) != 1 || len(e.Records()) != 1 || len(f.Records()) != 1 {
+		t.Errorf("records written after direct edits: d=%d e=%d f=%d, want 1 1 1", len(d.Records()), len(e.Records()), len(f.Records()))
+	}
+	l.Close()
+	if len(l) != 0 {
+		t.Errorf("Close left %d filters in the map", len(l))
+	}
+
+	// Loggers without settings are not kept once they have no filters.
+	for _, l := range []Logger{make(Logger), l} {
+		l.Info("message")
+		l.Enabled(INFO)
+		if _, ok := loggerStates.Load(l.key()); ok {
+			t.Errorf("state of %v kept after Info and Enabled", l)
+		}
+	}
+}
+
+// filterCount returns the number of filters of l.
+func filterCount(l Logger) int {
+	names, _ := l.state().levels()
+	return len(names)
+}
+
+func TestLoggerConcurrentFilters(t *testing.T) {
+	l := make(Logger).AddFilter("base", FINEST, &recordWriter{})
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					l.Infof("message %d", 1)
+					l.Info("message", Int("n", 1))
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if filt := l.Filter("base"); filt == nil || filt.Level > CRITICAL {
+					t.Errorf("Filter(base) = %v", filt)
+				}
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("f%d", i%5)
+		l.AddFilter(name, INFO, &recordWriter{})
+		l.SetFilterLevel("base", Level(i%int(CRITICAL)))
+		l.RemoveFilter(name)
+	}
+	close(stop)
+	wg.Wait()
+	l.Close()
+}
+
+func TestLoggerWith(t *testing.T) {
+	w := &recordWriter{}
+	l := make(Logger).AddFilter("rec", INFO, w)
+
+	req := l.With(String("request_id", "abc"))
+	req.Info("handled", Int("status", 200))
+	req.With(Int("attempt", 2)).Warnf("retry %d", 2)
+	req.Debug("not logged")
+	l.Info("plain")
+
+	// Filters added to the parent are shared with derived loggers.
+	w2 := &recordWriter{}
+	l.AddFilter("rec2", INFO, w2)
+	req.Info("shared")
+
+	recs := w.Records()
+	if len(recs) != 4 {
+		t.Fatalf("got %d records, want 4", len(recs))
+	}
+	keys := func(rec *LogRecord) string {
+		var k []string
+		for _, f := range rec.Fields {
+			k = append(k, f.Key)
+		}
+		return fmt.Sprint(k)
+	}
+	for i, want := range []string{"[request_id status]", "[request_id attempt]", "[]", "[request_id]"} {
+		if got := keys(recs[i]); got != want {
+			t.Errorf("record %d (%q) has fields %s, want %s", i, recs[i].Message, got, want)
+		}
+	}
+	if recs[1].Message != "retry 2" || !recs[1].Json {
+		t.Errorf("Warnf on derived logger: message %q json %v", recs[1].Message, recs[1].Json)
+	}
+	if n := len(w2.Records()); n != 1 {
+		t.Errorf("filter added to parent got %d records, want 1", n)
+	}
+	l.Close()
+}
+
+func TestGetLogger(t *testing.T) {
+	defer func(global Logger) {
+		Global = global
+	}(Global)
+	root := &recordWriter{}
+	Global = make(Logger).AddFilter("root", FINEST, root)
+
+	db, pool := GetLogger("test.db"), GetLogger("test.db.pool")
+	if pool.Name() != "test.db.pool" || GetLogger("test.db") == nil || Global.Name() != "" {
+		t.Fatalf("unexpected names: %q %q", pool.Name(), Global.Name())
+	}
+	dbw := &recordWriter{}
+	db.AddFilter("db", FINEST, dbw)
+
+	// Levels are inherited from the nearest ancestor.
+	GetLogger("test").SetLevel(INFO)
+	pool.Debug("dropped")
+	pool.Info("kept")
+	if pool.Enabled(DEBUG) || !pool.Enabled(INFO) {
+		t.Errorf("pool.Enabled: DEBUG=%v INFO=%v, want false true", pool.Enabled(DEBUG), pool.Enabled(INFO))
+	}
+	GetLogger("test").InheritLevel()
+
+	// Turning off additivity keeps the subtree away from the root logger.
+	db.SetAdditivity(false)
+	pool.Info("db only")
+	db.SetAdditivity(true)
+
+	if got := len(dbw.Records()); got != 2 {
+		t.Errorf("db filter got %d records, want 2", got)
+	}
+	recs := root.Records()
+	if len(recs) != 1 || recs[0].Message != "kept" {
+		t.Fatalf("root filter got %d records, want only %q", len(recs), "kept")
+	}
+	if got, want := FormatLogRecord("[%N] %M", recs[0]), "[test.db.pool] kept\n"; got != want {
+		t.Errorf("FormatLogRecord(%%N) = %q, want %q", got, want)
+	}
+	db.Close()
+}
+
+type testTraceKey struct{}
+
+func contextFieldsTestSave() []ContextExtractor {
+	old, _ := contextExtractors.Load().([]ContextExtractor)
+	return old
+}
+
+func TestContextExtractor(t *testing.T) {
+	defer func(old []ContextExtractor) {
+		contextExtractors.Store(old)
+	}(contextFieldsTestSave())
+	RegisterContextExtractor(func(ctx context.Context) []Field {
+		if id, ok := ctx.Value(testTraceKey{}).(string); ok {
+			return []Field{String("trace_id", id)}
+		}
+		return nil
+	})
+
+	w := &recordWriter{}
+	l := make(Logger).AddFilter("rec", INFO, w)
+	defer l.Close()
+
+	ctx := context.WithValue(context.Background(), testTraceKey{}, "4bf92f3577b34da6")
+	l.With(String("tenant", "acme")).InfoCtx(ctx, "handled", Int("status", 200))
+	l.InfoCtx(context.Background(), "no trace")
+
+	recs := w.Records()
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	var got []string
+	for _, f := range recs[0].Fields {
+		got = append(got, f.Key+"="+f.String)
+	}
+	if want := "[tenant=acme trace_id=4bf92f3577b34da6 status=]"; fmt.Sprint(got) != want {
+		t.Errorf("fields = %v, want %s", got, want)
+	}
+	if len(recs[1].Fields) != 0 {
+		t.Errorf("record without trace has fields %v", recs[1].Fields)
+	}
+}
+
+func TestSamplingLogWriter(t *testing.T) {
+	w := &recordWriter{}
+	s := NewSamplingLogWriter(w, time.Hour, 2, 3)
+
+	for i := 0; i < 10; i++ {
+		s.LogWrite(newLogRecordTest(DEBUG, "source", "hot"))
+	}
+	s.LogWrite(newLogRecordTest(INFO, "source", "hot"))
+
+	var got []string
+	for _, rec := range w.Records() {
+		got = append(got, rec.Message)
+	}
+	want := "[hot hot hot (2 similar records dropped) hot (2 similar records dropped) hot]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("sampled messages = %s, want %s", got, want)
+	}
+	if n := s.Dropped(); n != 6 {
+		t.Errorf("Dropped() = %d, want 6", n)
+	}
+}
+
+func TestDedupLogWriter(t *testing.T) {
+	w := &recordWriter{}
+	d := NewDedupLogWriter(w, 0)
+	for i := 0; i < 4; i++ {
+		d.LogWrite(newLogRecordTest(ERROR, "source", "dial failed"))
+	}
+	d.LogWrite(newLogRecordTest(INFO, "source", "recovered"))
+	d.LogWrite(newLogRecordTest(INFO, "source", "recovered"))
+	d.Close()
+
+	var got []string
+	for _, rec := range w.Records() {
+		got = append(got, rec.Level.String()+" "+rec.Message)
+	}
+	want := "[EROR dial failed EROR last message repeated 3 times INFO recovered INFO last message repeated 1 times]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("deduplicated records = %s, want %s", got, want)
+	}
+	if !w.closed {
+		t.Errorf("Close did not close the underlying writer")
+	}
+
+	// A run still going on is reported after the timeout.
+	w = &recordWriter{}
+	d = NewDedupLogWriter(w, 10*time.Millisecond)
+	d.LogWrite(newLogRecordTest(ERROR, "source", "dial failed"))
+	d.LogWrite(newLogRecordTest(ERROR, "source", "dial failed"))
+	time.Sleep(50 * time.Millisecond)
+	if recs := w.Records(); len(recs) != 2 || recs[1].Message != "last message repeated 1 times" {
+		t.Errorf("timeout did not report the repeated record: %d records", len(recs))
+	}
+	d.Close()
+}
+
+func TestMatchFilter(t *testing.T) {
+	w := &recordWriter{}
+	l := make(Logger).AddMatchFilter("db", ERROR, MatchSource(regexp.MustCompile(`/db/[^/]*\.go:`)), w)
+	defer l.Close()
+
+	l.Log(ERROR, "/src/app/db/pool.go:12", "db error")
+	l.Log(WARNING, "/src/app/db/pool.go:12", "db warning")
+	l.Log(ERROR, "/src/app/http/server.go:40", "http error")
+
+	if recs := w.Records(); len(recs) != 1 || recs[0].Message != "db error" {
+		t.Errorf("MatchSource let through %d records, want only %q", len(recs), "db error")
+	}
+
+	rec := &LogRecord{Level: WARNING, Message: "slow query", Fields: []Field{String("component", "db"), Int("ms", 1200)}}
+	tests := []struct {
+		m    Matcher
+		want bool
+	}{
+		{MatchLevelRange(INFO, WARNING), true},
+		{MatchLevelRange(ERROR, CRITICAL), false},
+		{MatchLevels(DEBUG, WARNING), true},
+		{MatchMessage("slow"), true},
+		{MatchField("ms"), true},
+		{MatchFieldValue("ms", "1200"), true},
+		{MatchFieldValue("component", "http"), false},
+		{MatchAll(MatchField("ms"), MatchMessage("fast")), false},
+		{MatchAny(MatchField("nope"), MatchMessage("query")), true},
+		{MatchNot(MatchMessage("query")), false},
+	}
+	for i, test := range tests {
+		if got := test.m.Match(rec); got != test.want {
+			t.Errorf("matcher %d: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestXMLMatchConfig(t *testing.T) {
+	const (
+		configfile = "_match.xml"
+		logfile    = "_match.log"
+	)
+	config := `<logging>
+  <filter enabled="true">
+    <tag>file</tag>
+    <type>file</type>
+    <level>FINEST</level>
+    <property name="filename">` + logfile + `</property>
+    <property name="format">%M</property>
+    <match><levels>DEBUG ERROR</levels></match>
+    <match><field key="component">db</field></match>
+  </filter>
+</logging>`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+	defer os.Remove(configfile)
+	defer os.Remove(logfile)
+
+	log := make(Logger)
+	log.LoadConfiguration(configfile)
+	log.Log(DEBUG, "source", "debug")
+	log.Log(INFO, "source", "info")
+	log.Info("db info", String("component", "db"))
+	log.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	contents, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatalf("Could not read %s: %s", logfile, err)
+	}
+	if got := string(contents); !strings.HasPrefix(got, "debug\n{") || !strings.Contains(got, `"message":"db info"`) || strings.Contains(got, "info\n") {
+		t.Errorf("unexpected log contents: %q", got)
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	l := make(Logger).AddFilter("stdout", INFO, &recordWriter{}).AddFilter("file", DEBUG, &recordWriter{})
+	defer l.Close()
+	h := l.LevelHandler()
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if got, want := rr.Body.String(), `[{"name":"stdout","level":"INFO"},{"name":"file","level":"DEBUG"}]`+"\n"; got != want {
+		t.Errorf("GET = %s, want %s", got, want)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("PUT", "/", strings.NewReader(`[{"name":"stdout","level":"FINEST"}]`)))
+	if rr.Code != http.StatusOK || !l.Enabled(FINEST) {
+		t.Errorf("PUT: status %d, Enabled(FINEST) = %v", rr.Code, l.Enabled(FINEST))
+	}
+
+	for body, code := range map[string]int{
+		`[{"name":"nope","level":"INFO"}]`:   http.StatusNotFound,
+		`[{"name":"stdout","level":"LOUD"}]`: http.StatusBadRequest,
+		`{`:                                  http.StatusBadRequest,
+	} {
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("PUT", "/", strings.NewReader(body)))
+		if rr.Code != code {
+			t.Errorf("PUT %s: status %d, want %d", body, rr.Code, code)
+		}
+	}
+}
+
+func TestLoggerHooks(t *testing.T) {
+	w := &recordWriter{}
+	l := make(Logger).AddFilter("rec", INFO, w)
+	defer l.Close()
+
+	l.AddHook(func(rec *LogRecord) bool {
+		return !strings.Contains(rec.Message, "secret")
+	})
+	l.AddHook(func(rec *LogRecord) bool {
+		rec.Fields = append(rec.Fields, String("host", "web-1"))
+		rec.Message = strings.ToUpper(rec.Message)
+		return true
+	})
+
+	caller := make([]Field, 1, 4)
+	caller[0] = Int("n", 1)
+	l.Info("hello", caller...)
+	l.Infof("a %s", "secret")
+	l.Log(WARNING, "source", "manual")
+	l.Debug("below level")
+
+	recs := w.Records()
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	if recs[0].Message != "HELLO" || len(recs[0].Fields) != 2 || recs[0].Fields[1].String != "web-1" {
+		t.Errorf("hooked record: %q %v", recs[0].Message, recs[0].Fields)
+	}
+	if caller[:2][1].Key != "" {
+		t.Errorf("hook appended into the caller's slice")
+	}
+	if recs[1].Message != "MANUAL" {
+		t.Errorf("Log did not run hooks: %q", recs[1].Message)
+	}
+
+	// Writers of text write the fields hooks add to unstructured records.
+	var buf strings.Builder
+	tl := make(Logger).AddFilter("text", INFO, NewFormatLogWriter(&buf, "[%L] %M")).AddHook(func(rec *LogRecord) bool {
+		rec.Fields = append(rec.Fields, String("host", "h1"))
+		return true
+	})
+	tl.Infof("plain %d", 1)
+	tl.Close()
+	if got, want := buf.String(), "[INFO] plain 1 host:h1\n"; got != want {
+		t.Errorf("text writer wrote %q, want %q", got, want)
+	}
+}
+
+func TestFatalAndPanic(t *testing.T) {
+	defer func(code int) {
+		ExitCode, exit = code, os.Exit
+		exitHooks = nil
+	}(ExitCode)
+	status := -1
+	exit = func(code int) { status = code }
+	ExitCode = 3
+	var hooked bool
+	RegisterExitHook(func() { hooked = true })
+
+	w := &recordWriter{}
+	l := make(Logger).AddFilter("rec", FINEST, w)
+	l.Finest("finest", Int("n", 0))
+	l.Trace("trace")
+	l.Fatal("fatal", String("reason", "disk full"))
+
+	if status != 3 || !hooked || !w.closed {
+		t.Errorf("Fatal: exit status %d, hooks run %v, writer closed %v", status, hooked, w.closed)
+	}
+	recs := w.Records()
+	if len(recs) != 3 || recs[2].Level != CRITICAL || recs[2].Fields[0].String != "disk full" {
+		t.Errorf("Fatal logged %d records", len(recs))
+	}
+
+	// The records of a named logger are written by the writers of Global
+	// before the program exits.
+	defer func(global Logger) {
+		Global = global
+	}(Global)
+	var buf strings.Builder
+	Global = make(Logger).AddFilter("buf", FINEST, NewFormatLogWriter(&buf, "%M"))
+	GetLogger("test.fatal").Fatal("fatal")
+	if got := buf.String(); got != "fatal\n" {
+		t.Errorf("Fatal of a named logger wrote %q to Global", got)
+	}
+	Global.Close()
+
+	// A writer that never finishes does not keep the program from exiting.
+	defer func(timeout time.Duration) {
+		FatalShutdownTimeout = timeout
+	}(FatalShutdownTimeout)
+	FatalShutdownTimeout = 10 * time.Millisecond
+	stuck := &gateWriter{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(stuck.release)
+	status = -1
+	make(Logger).AddFilter("stuck", FINEST, NewFormatLogWriter(stuck, "%M")).Fatal("fatal")
+	if status != 3 {
+		t.Errorf("Fatal with a stuck writer: exit status %d", status)
+	}
+
+	w = &recordWriter{}
+	l = make(Logger).AddFilter("rec", FINEST, w)
+	defer func() {
+		r := recover()
+		l.Info("recovered")
+		if r != "boom" || w.closed || len(w.Records()) != 2 {
+			t.Errorf("Panic: recovered %v, writer closed %v, %d records", r, w.closed, len(w.Records()))
+		}
+	}()
+	l.Panic("boom")
+}
+
+// logHelper stands in for a package that wraps log4go.
+func logHelper(l Logger, msg string) {
+	l.WithCallerSkip(1).Info(msg)
+}
+
+func TestCallerCapture(t *testing.T) {
+	w := &recordWriter{}
+	l := make(Logger).AddFilter("rec", INFO, w)
+	defer l.Close()
+
+	_, file, line, _ := runtime.Caller(0)
+	logHelper(l, "wrapped")
+	l.With(Int("n", 1)).WithCallerSkip(0).Info("direct")
+
+	recs := w.Records()
+	if want := fmt.Sprintf("%s:%d", file, line+1); recs[0].Source != want {
+		t.Errorf("WithCallerSkip: source %q, want %q", recs[0].Source, want)
+	}
+	if want := "github.com/wfireleaves/log4go.TestCallerCapture"; recs[1].Func != want || len(recs[1].Fields) != 1 {
+		t.Errorf("func %q (fields %v), want %q", recs[1].Func, recs[1].Fields, want)
+	}
+	if got := FormatLogRecord("%F", recs[1]); !strings.HasSuffix(got, "TestCallerCapture\n") {
+		t.Errorf("FormatLogRecord(%%F) = %q", got)
+	}
+
+	dir := file[:strings.LastIndex(file, "/")+1]
+	l.SetCallerTrim("/nonexistent/", dir)
+	l.Info("trimmed")
+	if recs = w.Records(); !strings.HasPrefix(recs[2].Source, "log4go_test.go:") {
+		t.Errorf("SetCallerTrim: source %q", recs[2].Source)
+	}
+
+	// Writers whose format does not use the caller do not get it.
+	console := NewConsoleLogWriter()
+	console.SetFormat("[%L] %M")
+	l.Close()
+	l.AddFilter("stdout", CRITICAL, console)
+	if s := l.state(); atomic.LoadInt32(&s.needs) != 0 {
+		t.Errorf("caller looked up for a console writer without %%S")
+	}
+	l.Close()
+
+	// Matchers on the source get it, whatever the writer writes; the others
+	// do not need it.
+	var matched, changed strings.Builder
+	ml := make(Logger).AddMatchFilter("levels", INFO, MatchAll(MatchLevelRange(INFO, ERROR), MatchField("k")), releaseWriter{})
+	if s := ml.state(); atomic.LoadInt32(&s.needs) != 0 {
+		t.Errorf("caller looked up for matchers on the level and fields")
+	}
+	ml.Close()
+	ml = make(Logger).AddMatchFilter("test", ERROR, MatchSource(regexp.MustCompile(`log4go_test\.go:`)), NewFormatLogWriter(&matched, "[%L] %M"))
+	ml.Error("from the test")
+	ml.Close()
+	if got := matched.String(); got != "[EROR] from the test\n" {
+		t.Errorf("MatchSource filter wrote %q", got)
+	}
+
+	// Changing the format after the filter is added is seen too.
+	fw := NewFormatLogWriter(&changed, "%M")
+	ml = make(Logger).AddFilter("changed", INFO, fw)
+	fw.SetEncoder(NewTextEncoder("%S %M"))
+	ml.Info("sourced")
+	ml.Close()
+	if got := changed.String(); !strings.HasPrefix(got, "log4go_test.go:") && !strings.Contains(got, "/log4go_test.go:") {
+		t.Errorf("writer with an encoder set after AddFilter wrote %q", got)
+	}
+
+	// So do hooks.
+	var hooked string
+	hl := make(Logger).AddFilter("discard", INFO, releaseWriter{}).AddHook(func(rec *LogRecord) bool {
+		hooked = rec.Source
+		return true
+	})
+	hl.Critical("hooked")
+	hl.Close()
+	if !strings.Contains(hooked, "log4go_test.go:") {
+		t.Errorf("hook saw source %q", hooked)
+	}
+}
+
+func TestStackTraces(t *testing.T) {
+	w := &recordWriter{}
+	l := make(Logger).AddFilter("rec", INFO, w).SetStackLevel(ERROR)
+	defer l.Close()
+
+	l.Info("no stack")
+	l.Errorf("failed: %d", 1)
+	l.Error("failed", Stack("trace"))
+
+	recs := w.Records()
+	if n := len(recs[0].Fields); n != 0 {
+		t.Errorf("INFO record has %d fields", n)
+	}
+	stack, ok := recs[1].Fields[0].Interface.([]StackFrame)
+	if !ok || len(stack) == 0 || !strings.HasSuffix(stack[0].Func, ".TestStackTraces") {
+		t.Fatalf("stack of Errorf = %v", recs[1].Fields)
+	}
+	if recs[1].Json {
+		t.Errorf("stack made a plain record structured")
+	}
+	if got := FormatLogRecord("[%L] %M", recs[1]); !strings.HasPrefix(got, "[EROR] failed: 1\n\t"+stack[0].String()+"\n") {
+		t.Errorf("FormatLogRecord = %q", got)
+	}
+
+	if n := len(recs[2].Fields); n != 2 {
+		t.Fatalf("Error with Stack has %d fields, want 2", n)
+	}
+	enc := newJsonEncoder()
+	got := enc.EncodeJson(recs[2])
+	if want := `,"trace": ["` + stack[0].Func; !strings.Contains(got, want) {
+		t.Errorf("EncodeJson = %q, want it to contain %q", got, want)
+	}
+}
+
+// failWriter fails every write.
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+// stuckWriter is a Flusher that never finishes flushing.
+type stuckWriter struct {
+	recordWriter
+	release chan struct{}
+}
+
+func (w *stuckWriter) Flush() error {
+	<-w.release
+	return nil
+}
+
+func TestFlushAndShutdown(t *testing.T) {
+	var buf strings.Builder
+	l := make(Logger).AddFilter("buf", INFO, NewFormatLogWriter(&buf, "%M"))
+	l.AddFilter("bad", INFO, NewFormatLogWriter(failWriter{}, "%M"))
+	for i := 0; i < 3*LogBufferLength; i++ {
+		l.Info("line")
+	}
+	err := l.Flush()
+	if got := strings.Count(buf.String(), "line\n"); got != 3*LogBufferLength {
+		t.Errorf("Flush: %d lines written, want %d", got, 3*LogBufferLength)
+	}
+	if derr, ok := err.(DrainError); !ok || len(derr) != 1 || derr["bad"] != io.ErrShortWrite {
+		t.Errorf("Flush = %v, want a DrainError for bad", err)
+	}
+	if err := l.Flush(); err != nil {
+		t.Errorf("second Flush = %v", err)
+	}
+	l.Close()
+
+	stuck := &stuckWriter{release: make(chan struct{})}
+	defer close(stuck.release)
+	l = make(Logger).AddFilter("stuck", INFO, stuck)
+	l.AddFilter("rec", INFO, &recordWriter{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = l.Shutdown(ctx)
+	if derr, ok := err.(DrainError); !ok || len(derr) != 1 || derr["stuck"] != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, want a DrainError for stuck", err)
+	}
+	if n := filterCount(l); n != 0 {
+		t.Errorf("Shutdown left %d filters", n)
+	}
+
+	// The writers of the ancestors of a named logger are flushed too, but
+	// only its own are closed.
+	defer func(global Logger) {
+		Global = global
+	}(Global)
+	buf.Reset()
+	Global = make(Logger).AddFilter("buf", INFO, NewFormatLogWriter(&buf, "%M"))
+	Global.AddFilter("bad", INFO, NewFormatLogWriter(failWriter{}, "%M"))
+	svc := GetLogger("test.flush")
+	own := &recordWriter{}
+	svc.AddFilter("own", INFO, own)
+	svc.Info("line")
+	err = svc.Flush()
+	if derr, ok := err.(DrainError); !ok || len(derr) != 1 || derr["/bad"] != io.ErrShortWrite || buf.String() != "line\n" {
+		t.Errorf("Flush of a named logger = %v, wrote %q", err, buf.String())
+	}
+	svc.Info("line")
+	err = svc.Shutdown(context.Background())
+	if derr, ok := err.(DrainError); !ok || len(derr) != 1 || derr["/bad"] != io.ErrShortWrite || buf.String() != "line\nline\n" {
+		t.Errorf("Shutdown of a named logger = %v, wrote %q", err, buf.String())
+	}
+	if !own.closed || filterCount(Global) != 2 {
+		t.Errorf("Shutdown of a named logger: own writer closed %v, Global has %d filters", own.closed, filterCount(Global))
+	}
+	Global.Close()
+
+	// Close waits for the file to be written.
+	defer os.Remove(testLogFile)
+	w := NewFileLogWriter(testLogFile, false)
+	w.SetFormat("%M")
+	for i := 0; i < LogBufferLength; i++ {
+		w.LogWrite(newLogRecordTest(INFO, "source", "line"))
+	}
+	w.Close()
+	if contents, err := ioutil.ReadFile(testLogFile); err != nil || strings.Count(string(contents), "line\n") != LogBufferLength {
+		t.Errorf("after Close: %q, %v", contents, err)
+	}
+}
+
+func TestWriterRecovery(t *testing.T) {
+	var mu sync.Mutex
+	var handled []error
+	SetErrorHandler(func(w LogWriter, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, err)
+	})
+	defer SetErrorHandler(nil)
+
+	defer os.Remove(testLogFile)
+	w := NewFileLogWriter(testLogFile, false).SetFormat("%M").SetRecovery(Recovery{Policy: DropOnError})
+	l := make(Logger).AddFilter("file", INFO, w)
+	l.Infof("one")
+	if err := l.Flush(); err != nil {
+		t.Fatalf("Flush = %v", err)
+	}
+
+	// The disk goes away under the writer.
+	w.file.Close()
+	l.Infof("lost")
+	if err, ok := l.Flush().(DrainError); !ok || err["file"] == nil {
+		t.Errorf("Flush after a failed write = %v", err)
+	}
+	if h := l.Health()["file"]; h.Healthy || h.Failures != 1 || h.LastError == nil {
+		t.Errorf("Health after a failed write = %+v", h)
+	}
+
+	// The file is opened again for the next record.
+	l.Infof("again")
+	if err := l.Flush(); err != nil {
+		t.Errorf("Flush after recovering = %v", err)
+	}
+	if h := l.Health()["file"]; !h.Healthy || h.Failures != 1 {
+		t.Errorf("Health after recovering = %+v", h)
+	}
+	l.Close()
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "one\nagain\n" {
+		t.Errorf("file contents %q", contents)
+	}
+	mu.Lock()
+	if len(handled) != 1 {
+		t.Errorf("ErrorHandler called %d times, want 1", len(handled))
+	}
+	handled = nil
+	mu.Unlock()
+
+	// Retries back off until the record is written.
+	h := newWriterHealth()
+	h.setRecovery(Recovery{Policy: RetryOnError, Retries: 3, Backoff: time.Millisecond})
+	tries := 0
+	h.write(nil, "", func() error {
+		if tries++; tries < 3 {
+			return io.ErrShortWrite
+		}
+		return nil
+	})
+	if got := h.Health(); tries != 3 || !got.Healthy || got.Failures != 0 || len(handled) != 2 {
+		t.Errorf("retry: %d tries, %d errors handled, health %+v", tries, len(handled), got)
+	}
+}
+
+func TestSocketJSON(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+
+	w := NewSocketLogWriter("tcp", ln.Addr().String())
+	rec := newLogRecordTest(INFO, "source", "message")
+	rec.Json = true
+	rec.Fields = []Field{
+		Object("user", ObjectMarshalerFunc(func(enc FieldEncoder) error {
+			enc.AddString("name", "ann")
+			return nil
+		})),
+		Ints("ids", []int{1, 2}),
+	}
+	w.LogWrite(rec)
+	if err := w.Flush(); err != nil {
+		t.Errorf("Flush = %v", err)
+	}
+	w.Close()
+
+	var got struct {
+		Message string
+		User    struct{ Name string }
+		IDs     []int
+	}
+	line := <-lines
+	if err := json.Unmarshal([]byte(line), &got); err != nil || got.Message != "message" || got.User.Name != "ann" || len(got.IDs) != 2 {
+		t.Errorf("sent %q (%v)", line, err)
+	}
+}
+
+func TestSocketRedialBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var handled []string
+	SetErrorHandler(func(w LogWriter, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, err.Error())
+	})
+	defer SetErrorHandler(nil)
+
+	// Nothing listens on the port once the listener is closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	w := NewSocketLogWriter("tcp", addr).SetRecovery(Recovery{Policy: DropOnError, Backoff: time.Hour})
+	time.Sleep(2 * DefaultRecovery.Backoff)
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecordTest(INFO, "source", "message"))
+	}
+	if err := w.Flush(); err == nil {
+		t.Errorf("Flush = nil, want the error of the lost records")
+	}
+	w.Close()
+
+	// The first record dials again; the others wait for the backoff.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 4 || strings.Contains(handled[1], "dialing again") || !strings.Contains(handled[2], "dialing again") || !strings.Contains(handled[3], "dialing again") {
+		t.Errorf("errors handled: %q", handled)
+	}
+	if h := w.Health(); h.Failures != 3 {
+		t.Errorf("Health = %+v, want 3 failures", h)
+	}
+}
+
+// gateWriter blocks every write until release is closed, after telling
+// started about the first.
+type gateWriter struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	buf     strings.Builder
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		overflow Overflow
+		lvls     []Level
+		dropped  uint64
+		want     string
+	}{
+		{Overflow{Policy: DropNewestOnFull}, []Level{INFO, INFO, INFO, INFO, INFO}, 3, "0\n1\n2\n"},
+		{Overflow{Policy: DropOldestOnFull}, []Level{INFO, INFO, INFO, INFO, INFO}, 3, "0\n4\n5\n"},
+		{Overflow{Policy: DropBelowOnFull, Level: ERROR}, []Level{INFO, INFO, INFO, INFO, INFO}, 3, "0\n1\n2\n"},
+		{Overflow{Policy: TimeoutOnFull, Timeout: time.Millisecond}, []Level{INFO, INFO, INFO}, 1, "0\n1\n2\n"},
+	}
+	for _, test := range tests {
+		out := &gateWriter{started: make(chan struct{}), release: make(chan struct{})}
+		w := NewFormatLogWriter(out, "%M").SetBufferSize(2).SetOverflow(test.overflow)
+
+		// The first record holds up the writer; two more fill its buffer.
+		w.LogWrite(newLogRecordTest(INFO, "source", "0"))
+		<-out.started
+		for i, lvl := range test.lvls {
+			w.LogWrite(newLogRecordTest(lvl, "source", fmt.Sprint(i+1)))
+		}
+		if got := w.Dropped(); got != test.dropped {
+			t.Errorf("%v: dropped %d, want %d", test.overflow.Policy, got, test.dropped)
+		}
+
+		close(out.release)
+		w.Close()
+		if got := out.buf.String(); got != test.want {
+			t.Errorf("%v: wrote %q, want %q", test.overflow.Policy, got, test.want)
+		}
+	}
+}
+
+func TestFlushAfterClose(t *testing.T) {
+	var buf strings.Builder
+	console := NewConsoleLogWriter().SetOutputs(&buf, nil, FINEST)
+	console.Close()
+	if err := console.Flush(); err == nil {
+		t.Errorf("Flush after Close = nil, want an error")
+	}
+	console.Close()
+
+	// A Close racing a Logger's Flush does not crash it.
+	for i := 0; i < 100; i++ {
+		l := make(Logger).AddFilter("text", INFO, NewFormatLogWriter(ioutil.Discard, "%M"))
+		l.Info("message")
+		done := make(chan struct{})
+		go func() {
+			l.Flush()
+			close(done)
+		}()
+		l.Close()
+		<-done
+	}
+}
+
+func TestDropOldestKeepsFlushes(t *testing.T) {
+	out := &gateWriter{started: make(chan struct{}), release: make(chan struct{})}
+	w := NewFormatLogWriter(out, "%M").SetBufferSize(2).SetOverflow(Overflow{Policy: DropOldestOnFull})
+	w.LogWrite(newLogRecordTest(INFO, "source", "0"))
+	<-out.started
+
+	// The flush is the oldest entry in the buffer when it fills up.
+	flushed := make(chan error)
+	go func() { flushed <- w.Flush() }()
+	for len(w.queue.ch) == 0 {
+		runtime.Gosched()
+	}
+	for i := 1; i <= 3; i++ {
+		w.LogWrite(newLogRecordTest(INFO, "source", fmt.Sprint(i)))
+	}
+	if got := w.Dropped(); got != 1 {
+		t.Errorf("dropped %d, want 1", got)
+	}
+
+	close(out.release)
+	if err := <-flushed; err != nil {
+		t.Errorf("Flush = %v", err)
+	}
+	w.Close()
+	if got, want := out.buf.String(), "0\n2\n3\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+
+	// The file writer takes the markers put back in front of its buffer too.
+	defer os.Remove(testLogFile)
+	fw := NewFileLogWriter(testLogFile, false)
+	defer fw.Close()
+	marker := newFlushRecord()
+	fw.queue.pushFront(marker)
+	select {
+	case err := <-marker.flush:
+		if err != nil {
+			t.Errorf("FileLogWriter flush = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("FileLogWriter did not answer a flush put back in front of its buffer")
+	}
+}
+
+func TestSharedRecordsUnchanged(t *testing.T) {
+	defer os.Remove(testLogFile)
+	var buf strings.Builder
+	rec := &recordWriter{}
+	l := make(Logger).
+		AddFilter("text", INFO, NewFormatLogWriter(&buf, "%M")).
+		AddFilter("json", INFO, NewJsonLogWriter(testLogFile, false)).
+		AddFilter("rec", INFO, rec)
+	l.Info("shared", Int("n", 1))
+	l.Close()
+
+	if recs := rec.Records(); len(recs) != 1 || recs[0].Message != "shared" {
+		t.Errorf("record changed by other writers: %q", recs[0].Message)
+	}
+	if got := buf.String(); got != "shared n:1\n" {
+		t.Errorf("text writer wrote %q", got)
+	}
+	contents, _ := ioutil.ReadFile(testLogFile)
+	if got := string(contents); !strings.Contains(got, `"message":"shared"`) || strings.Contains(got, "n:1") {
+		t.Errorf("json writer wrote %q", got)
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	rec := newLogRecordTest(INFO, "source.go:1", "hello world")
+	rec.Fields = []Field{String("100%d", "a b"), Int("n", -3), Bool("ok", true)}
+	rec.Json = true
+
+	tests := []struct {
+		enc  Encoder
+		want string
+	}{
+		{NewTextEncoder("[%L] %M"), "[INFO] hello world 100%d:a b n:-3 ok:true\n"},
+		{NewLogfmtEncoder(), `time=2009-02-13T23:31:30.123456789Z level=INFO source=source.go:1 msg="hello world" 100%d="a b" n=-3 ok=true` + "\n"},
+	}
+	for _, test := range tests {
+		if got := test.enc.Clone().EncodeRecord(rec); got != test.want {
+			t.Errorf("EncodeRecord = %q, want %q", got, test.want)
+		}
+	}
+
+	// A value with a newline in it can't split the text line.
+	rec.Fields = []Field{String("s", "a\nb"), String("k\tey", "ok")}
+	if got, want := NewTextEncoder("%M").EncodeRecord(rec), "hello world s:\"a\\nb\" \"k\\tey\":ok\n"; got != want {
+		t.Errorf("EncodeRecord = %q, want %q", got, want)
+	}
+
+	// Any writer takes any encoder, whichever method logged the record.
+	var js, text strings.Builder
+	l := make(Logger).
+		AddFilter("json", INFO, NewFormatLogWriter(&js, "%M").SetEncoder(NewJSONEncoder())).
+		AddFilter("text", INFO, NewFormatLogWriter(&text, "%M").SetEncoder(NewTextEncoder("%L %M")))
+	l.Infof("plain %d", 1)
+	l.Info("structured", Int("n", 2))
+	l.Close()
+	if got := js.String(); !strings.Contains(got, `"message":"plain 1"`) || !strings.Contains(got, `"n": 2}`) {
+		t.Errorf("json writer wrote %q", got)
+	}
+	if got := text.String(); got != "INFO plain 1\nINFO structured n:2\n" {
+		t.Errorf("text writer wrote %q", got)
+	}
+}
+
+func TestJSONEncoderConfig(t *testing.T) {
+	rec := newLogRecordTest(WARNING, "source.go:1", `say "hi"`+"\n")
+	rec.Name = "db"
+	rec.Fields = []Field{String("user", `a"b`)}
+	rec.Json = true
+
+	tests := []struct {
+		cfg  JSONEncoderConfig
+		want string
+	}{
+		{DefaultJSONEncoderConfig, `{"time":"2009-02-13 23:31:30.12345","message":"say \"hi\"\n","level":"WARN","file":"source.go:1","logger":"db","user": "a\"b"}` + "\n"},
+		{JSONEncoderConfig{MessageKey: "msg", TimeFormat: EpochMillisTime, LevelStyle: FullLevel, OmitCaller: true},
+			`{"time":1234567890123,"msg":"say \"hi\"\n","level":"WARNING","logger":"db","user": "a\"b"}` + "\n"},
+		{JSONEncoderConfig{TimeFormat: RFC3339NanoTime, OmitTime: true}, `{"message":"say \"hi\"\n","level":"WARN","file":"source.go:1","logger":"db","user": "a\"b"}` + "\n"},
+		{ECSEncoderConfig(), `{"@timestamp":"2009-02-13T23:31:30.123456789Z","message":"say \"hi\"\n","log.level":"WARNING","log.origin.file.name":"source.go:1","log.logger":"db","user": "a\"b","ecs.version":"1.6.0"}` + "\n"},
+	}
+	for _, test := range tests {
+		got := NewJSONEncoderWithConfig(test.cfg).Clone().EncodeRecord(rec)
+		if got != test.want {
+			t.Errorf("EncodeRecord = %q, want %q", got, test.want)
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(got), &obj); err != nil {
+			t.Errorf("EncodeRecord wrote invalid JSON %q: %s", got, err)
+		}
+	}
+
+	gelf := NewJSONEncoderWithConfig(GELFEncoderConfig()).EncodeRecord(rec)
+	for _, want := range []string{`"timestamp":1234567890.123456,`, `"short_message":`, `"level":4,`, `"_logger":"db"`, `"_user": "a\"b"`, `"version":"1.1"`} {
+		if !strings.Contains(gelf, want) {
+			t.Errorf("GELF EncodeRecord = %q, want it to contain %q", gelf, want)
+		}
+	}
+
+	// JSON has no numbers for NaN and the infinities.
+	rec.Fields = []Field{Float64("nan", math.NaN()), Float32("inf", float32(math.Inf(1))), Float64s("fs", []float64{math.Inf(-1), 1.5})}
+	got := NewJSONEncoderWithConfig(JSONEncoderConfig{OmitTime: true, OmitCaller: true}).EncodeRecord(rec)
+	if want := `"nan": "NaN","inf": "+Inf","fs": ["-Inf",1.5]`; !strings.Contains(got, want) {
+		t.Errorf("EncodeRecord = %q, want it to contain %q", got, want)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &obj); err != nil {
+		t.Errorf("EncodeRecord wrote invalid JSON %q: %s", got, err)
+	}
+}
+
+type testUser struct {
+	Name string
+	Tags []string
+}
+
+func (u testUser) MarshalLogObject(enc FieldEncoder) error {
+	enc.AddString("name", u.Name)
+	return enc.AddArray("tags", stringArray(u.Tags))
+}
+
+func TestNestedFields(t *testing.T) {
+	rec := newLogRecordTest(INFO, "source.go:1", "login")
+	rec.Json = true
+	rec.Fields = []Field{
+		Object("user", testUser{"bob", []string{"a", "b"}}),
+		Ints("ids", []int{1, 2}),
+		Any("attrs", map[string]interface{}{"k": []int{3}, "html": "<b>"}),
+		Array("matrix", ArrayMarshalerFunc(func(enc ArrayEncoder) error {
+			enc.AppendArray(ints{1})
+			return enc.AppendObject(testUser{Name: "x"})
+		})),
+		Object("bad", ObjectMarshalerFunc(func(enc FieldEncoder) error {
+			return errors.New("oops")
+		})),
+		Namespace("req"),
+		String("id", "r1"),
+	}
+
+	enc := NewJSONEncoderWithConfig(JSONEncoderConfig{OmitTime: true, OmitCaller: true})
+	got := enc.EncodeRecord(rec)
+	want := `{"message":"login","level":"INFO","user": {"name": "bob","tags": ["a","b"]},"ids": [1,2],` +
+		`"attrs": {"html":"<b>","k":[3]},"matrix": [[1],{"name": "x","tags": []}],"bad": {},"badError": "oops",` +
+		`"req": {"id": "r1"}}` + "\n"
+	if got != want {
+		t.Errorf("EncodeRecord = %q, want %q", got, want)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &obj); err != nil {
+		t.Errorf("EncodeRecord wrote invalid JSON: %s", err)
+	}
+
+	rec.Fields = rec.Fields[:2]
+	if got, want := NewLogfmtEncoder().EncodeRecord(rec), `user.name=bob user.tags="[\"a\",\"b\"]" ids=[1,2]`+"\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("logfmt EncodeRecord = %q, want suffix %q", got, want)
+	}
+}
+
+type testStringer struct{ s string }
+
+func (v *testStringer) String() string { return v.s }
+
+func TestRicherFields(t *testing.T) {
+	rec := newLogRecordTest(INFO, "source.go:1", "m")
+	rec.Json = true
+	rec.Fields = []Field{
+		Duration("took", 1500*time.Millisecond),
+		Time("at", now),
+		Stringer("s", &testStringer{"str"}),
+		Stringer("nilptr", (*testStringer)(nil)),
+		Binary("raw", []byte("hi!")),
+		NamedErr("cause", errors.New("boom")),
+		Err(nil),
+		Uint64("big", math.MaxUint64),
+	}
+
+	enc := NewJSONEncoderWithConfig(JSONEncoderConfig{OmitTime: true, OmitCaller: true, TimeFormat: RFC3339NanoTime})
+	want := `{"message":"m","level":"INFO","took": "1.5s","at": "2009-02-13T23:31:30.123456789Z","s": "str",` +
+		`"nilptr": "<PANIC=runtime error: invalid memory address or nil pointer dereference>","raw": "aGkh",` +
+		`"cause": "boom","causeType": "*errors.errorString","error": "nil","big": 18446744073709551615}` + "\n"
+	if got := enc.EncodeRecord(rec); got != want {
+		t.Errorf("EncodeRecord = %q, want %q", got, want)
+	}
+	want = "m took:1.5s at:2009-02-13T23:31:30.123456789Z s:str "
+	if got := NewTextEncoder("%M").EncodeRecord(rec); !strings.HasPrefix(got, want) || !strings.Contains(got, "raw:aGkh cause:boom causeType:*errors.errorString error:nil big:18446744073709551615\n") {
+		t.Errorf("text EncodeRecord = %q", got)
+	}
+
+	anys := []struct {
+		value interface{}
+		typ   FieldType
+	}{
+		{uint8(1), Uint8Type}, {int8(1), Int8Type}, {int32(1), Int32Type}, {uint32(1), Uint32Type},
+		{int64(1), Int64Type}, {uint64(math.MaxUint64), Uint64Type}, {true, BoolType}, {1.5, Float64Type},
+		{time.Second, DurationType}, {now, TimeType}, {[]byte("x"), BinaryType}, {io.EOF, ErrorType},
+		{&testStringer{"x"}, StringType}, {struct{}{}, InterfaceType},
+	}
+	for _, test := range anys {
+		if f := Any("k", test.value); f.Type != test.typ {
+			t.Errorf("Any(%#v).Type = %d, want %d", test.value, f.Type, test.typ)
+		}
+	}
+	if f := Any("k", uint64(math.MaxUint64)); f.valueString() != "18446744073709551615" {
+		t.Errorf("Any(MaxUint64) = %s", f.valueString())
+	}
+}
+
+type testStackError struct {
+	msg  string
+	pcs  []uintptr
+	code int
+}
+
+func newTestStackError(msg string) *testStackError {
+	pcs := make([]uintptr, 8)
+	return &testStackError{msg: msg, pcs: pcs[:runtime.Callers(1, pcs)], code: 42}
+}
+
+func (e *testStackError) Error() string      { return e.msg }
+func (e *testStackError) Callers() []uintptr { return e.pcs }
+
+func (e *testStackError) MarshalLogObject(enc FieldEncoder) error {
+	enc.AddInt("code", e.code)
+	return nil
+}
+
+func TestErrorFields(t *testing.T) {
+	root := newTestStackError("disk full")
+	err := fmt.Errorf("save: %w", fmt.Errorf("write: %w", root))
+
+	rec := newLogRecordTest(ERROR, "source.go:1", "failed")
+	rec.Json = true
+	rec.Fields = []Field{NamedErr("err", err)}
+
+	got := NewJSONEncoderWithConfig(JSONEncoderConfig{OmitTime: true, OmitCaller: true}).EncodeRecord(rec)
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &obj); err != nil {
+		t.Fatalf("EncodeRecord wrote invalid JSON %q: %s", got, err)
+	}
+	if obj["err"] != "save: write: disk full" || obj["errType"] != "*fmt.wrapError" {
+		t.Errorf("EncodeRecord = %q, want the text and type of the error", got)
+	}
+	if causes := fmt.Sprint(obj["errCauses"]); causes != "[write: disk full disk full]" {
+		t.Errorf("errCauses = %s, want the unwrapped chain", causes)
+	}
+	if stack, _ := obj["errStack"].([]interface{}); len(stack) == 0 || !strings.Contains(stack[0].(string), "newTestStackError") {
+		t.Errorf("errStack = %v, want the stack of the cause", obj["errStack"])
+	}
+	if _, ok := obj["errFields"]; ok {
+		t.Errorf("EncodeRecord = %q, want no fields from an error that is not an ObjectMarshaler", got)
+	}
+
+	rec.Fields = []Field{Err(root)}
+	got = NewJSONEncoderWithConfig(JSONEncoderConfig{OmitTime: true, OmitCaller: true}).EncodeRecord(rec)
+	if !strings.Contains(got, `"errorFields": {"code": 42}`) || strings.Contains(got, "errorCauses") {
+		t.Errorf("EncodeRecord = %q, want the fields of the error and no causes", got)
+	}
+	if got := FormatLogRecord("%M", rec); !strings.Contains(got, "\tgithub.com/wfireleaves/log4go.newTestStackError (") {
+		t.Errorf("FormatLogRecord = %q, want the stack of the error", got)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	r := NewRedactor().
+		RedactKeys(RedactMask, "*password*", "authorization").
+		RedactKeys(RedactHash, "token").
+		RedactKeys(RedactTruncate, "card").
+		RedactCards().RedactEmails().RedactIPs()
+
+	var out strings.Builder
+	l := make(Logger).AddFilter("json", FINEST, NewFormatLogWriter(&out, "").SetEncoder(NewJSONEncoderWithConfig(JSONEncoderConfig{OmitTime: true, OmitCaller: true})))
+	l.SetRedactor(r)
+
+	fields := []Field{
+		String("DB_Password", "hunter2"),
+		String("token", "abc"),
+		String("card", "4111111111111111"),
+		Any("config", map[string]interface{}{"user": "bob", "nested": []interface{}{map[string]string{"Authorization": "Bearer x"}}}),
+		Object("req", testUser{Name: "bob"}),
+		String("user", "bob"),
+	}
+	l.Info("paid with 4111 1111 1111 1111 (not 1234567890123) from bob@example.com at 10.0.0.1 and fe80::1 in std::string", fields...)
+	l.Close()
+
+	got := out.String()
+	for _, want := range []string{
+		`"message":"paid with [CARD] (not 1234567890123) from [EMAIL] at [IP] and [IP] in std::string"`,
+		`"DB_Password": "[REDACTED]"`,
+		`"token": "sha256:ba7816bf8f01cfea"`,
+		`"card": "4111..."`,
+		`"config": {"nested":[{"Authorization":"[REDACTED]"}],"user":"bob"}`,
+		`"req": {"name": "bob","tags": []}`,
+		`"user": "bob"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("redacted output %q, want it to contain %q", got, want)
+		}
+	}
+	if fields[0].String != "hunter2" {
+		t.Errorf("Redact changed the caller's fields: %+v", fields[0])
+	}
+
+	// Keys inside objects are checked as they are encoded.
+	rec := newLogRecordTest(INFO, "source.go:1", "m")
+	rec.Fields = []Field{Object("user", testUser{Name: "bob"})}
+	NewRedactor().RedactKeys(RedactMask, "name").Redact(rec)
+	if got := NewTextEncoder("%M").EncodeRecord(rec); got != "m user.name:[REDACTED] user.tags:[]\n" {
+		t.Errorf("EncodeRecord = %q", got)
+	}
+
+	// Only text that is an IP address is taken for one.
+	for in, want := range map[string]string{
+		"from 192.168.0.1:80":            "from [IP]:80",
+		"from 2001:db8::8a2e:370:7334":   "from [IP]",
+		"from 2001:0db8:0:0:0:0:2:1 now": "from [IP] now",
+		"from fe80:1:: and ::ffff:a now": "from [IP] and [IP] now",
+		"std::string and deadbeef:: now": "std::string and deadbeef:: now",
+		"a :: b, ::1 and 12:30":          "a :: b, ::1 and 12:30",
+	} {
+		if got := IPPattern.ReplaceAllString(in, "[IP]"); got != want {
+			t.Errorf("IPPattern replaced in %q: %q, want %q", in, got, want)
+		}
+	}
+
+	// Closing the logger keeps its Redactor for the filters added after.
+	var again strings.Builder
+	l.AddFilter("json", FINEST, NewFormatLogWriter(&again, "").SetEncoder(NewJSONEncoderWithConfig(JSONEncoderConfig{OmitTime: true, OmitCaller: true})))
+	l.Info("again", String("DB_Password", "hunter2"))
+	l.Close()
+	if got := again.String(); strings.Contains(got, "hunter2") {
+		t.Errorf("output after Close %q, want the password redacted", got)
+	}
+}
+
+func TestXMLRedactConfig(t *testing.T) {
+	const (
+		configfile = "_redact.xml"
+		logfile    = "_redact.log"
+	)
+	config := `<logging>
+  <redact placeholder="***">
+    <key>*secret*</key>
+    <key mode="truncate">session</key>
+    <message builtin="email"/>
+    <message replace="user-#">user-\d+</message>
+  </redact>
+  <filter enabled="true">
+    <tag>file</tag>
+    <type>file</type>
+    <level>FINEST</level>
+    <property name="filename">` + logfile + `</property>
+    <property name="encoder">logfmt</property>
+  </filter>
+</logging>`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+	defer os.Remove(configfile)
+	defer os.Remove(logfile)
+
+	log := make(Logger)
+	log.LoadConfiguration(configfile)
+	log.Info("user-42 is a@b.io", String("api_secret", "s3"), String("session", "0123456789"))
+	log.Close()
+
+	contents, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatalf("Could not read %s: %s", logfile, err)
+	}
+	if got := string(contents); !strings.Contains(got, `msg="user-# is [EMAIL]" api_secret=*** session=0123...`) {
+		t.Errorf("unexpected log contents: %q", got)
+	}
+}
+
+func TestConsoleColor(t *testing.T) {
+	t.Setenv("FORCE_COLOR", "")
+	os.Unsetenv("FORCE_COLOR")
+	var buf strings.Builder
+	defer func(old io.Writer) { stdout = old }(stdout)
+	stdout = &buf
+
+	w := NewConsoleLogWriter().SetColor(ColorAlways)
+	w.SetFormat("[%L] %M")
+	l := make(Logger).AddFilter("stdout", FINEST, w)
+	l.Warn("disk", Int("free", 3))
+	l.Close()
+
+	w = NewConsoleLogWriter().SetColor(ColorAlways)
+	w.SetFormat("%C[%L]%c %M")
+	l = make(Logger).AddFilter("stdout", FINEST, w)
+	l.Logf(ERROR, "failed")
+	l.Close()
+
+	w = NewConsoleLogWriter()
+	w.SetFormat("%C[%L]%c %M")
+	l = make(Logger).AddFilter("stdout", FINEST, w)
+	l.Logf(ERROR, "plain")
+	l.Close()
+
+	want := "[\x1b[33mWARN\x1b[0m] disk \x1b[36mfree:\x1b[0m\x1b[35m3\x1b[0m\n" +
+		"\x1b[31m[EROR]\x1b[0m failed\n" +
+		"[EROR] plain\n"
+	if got := buf.String(); got != want {
+		t.Errorf("console wrote %q, want %q", got, want)
+	}
+
+	var file strings.Builder
+	tests := []struct {
+		force, no, term string
+		out             io.Writer
+		want            bool
+	}{
+		{"", "", "", &file, false},
+		{"1", "", "", &file, true},
+		{"0", "", "", &file, false},
+		{"1", "1", "", &file, true},
+		{"", "1", "", os.Stdout, false},
+		{"", "", "dumb", os.Stdout, false},
+	}
+	for _, test := range tests {
+		for env, value := range map[string]string{"FORCE_COLOR": test.force, "NO_COLOR": test.no, "TERM": test.term} {
+			t.Setenv(env, value)
+			if value == "" {
+				os.Unsetenv(env)
+			}
+		}
+		if got := useColor(ColorAuto, test.out); got != test.want {
+			t.Errorf("useColor(FORCE_COLOR=%q NO_COLOR=%q TERM=%q) = %v, want %v", test.force, test.no, test.term, got, test.want)
+		}
+	}
+	if useColor(ColorNever, &file) || !useColor(ColorAlways, &file) {
+		t.Errorf("useColor ignored an explicit mode")
+	}
+}
+
+func TestConsoleStreams(t *testing.T) {
+	var low, high strings.Builder
+	w := NewConsoleLogWriter().SetOutputs(&low, &high, WARNING)
+	w.SetFormat("[%L] %M")
+	l := make(Logger).AddFilter("stdout", FINEST, w)
+	for i, lvl := range []Level{DEBUG, WARNING, INFO, ERROR, CRITICAL, TRACE} {
+		l.Logf(lvl, "%d", i)
+	}
+	l.Close()
+	if got, want := low.String(), "[DEBG] 0\n[INFO] 2\n[TRAC] 5\n"; got != want {
+		t.Errorf("low stream got %q, want %q", got, want)
+	}
+	if got, want := high.String(), "[WARN] 1\n[EROR] 3\n[CRIT] 4\n"; got != want {
+		t.Errorf("high stream got %q, want %q", got, want)
+	}
+
+	// The XML console filter routes to stdout and stderr.
+	const configfile = "_streams.xml"
+	config := `<logging>
+  <filter enabled="true">
+    <tag>stdout</tag>
+    <type>console</type>
+    <level>FINEST</level>
+    <property name="format">%M</property>
+    <property name="stderrlevel">ERROR</property>
+  </filter>
+</logging>`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+	defer os.Remove(configfile)
+
+	var out, errOut strings.Builder
+	defer func(o, e io.Writer) { stdout, stderr = o, e }(stdout, stderr)
+	stdout, stderr = &out, &errOut
+	log := make(Logger)
+	log.LoadConfiguration(configfile)
+	log.Logf(WARNING, "warn")
+	log.Logf(ERROR, "error")
+	log.Close()
+	if out.String() != "warn\n" || errOut.String() != "error\n" {
+		t.Errorf("stdout got %q and stderr %q", out.String(), errOut.String())
+	}
+}
+
+func TestFieldsSnapshot(t *testing.T) {
+	var out strings.Builder
+	w := NewConsoleLogWriter().SetOutputs(&out, nil, FINEST).SetEncoder(NewJSONEncoderWithConfig(JSONEncoderConfig{OmitTime: true, OmitCaller: true}))
+	l := make(Logger).AddFilter("json", FINEST, w)
+
+	// The values are changed while the writer may still be encoding them.
+	m := map[string]int{"a": 0}
+	ids := []int{0}
+	b := []byte("0")
+	fields := []Field{Any("m", m), Ints("ids", ids), Binary("b", b)}
+	l.Info("logged", fields...)
+	m["a"], ids[0], b[0] = 1, 1, '1'
+	fields[0] = String("m", "changed")
+	l.Close()
+
+	got := out.String()
+	for _, want := range []string{`"m": {"a":0}`, `"ids": [0]`, `"b": "MA=="`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output %q, want it to contain %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// NewLogfmtEncoder returns an Encoder that writes each record as a line of
+// key=value pairs: time, level, logger, source, func and msg, followed by the
+// fields.  Values are quoted when they need to be.
+func NewLogfmtEncoder() Encoder {
+	return &logfmtEncoder{}
+}
+
+type logfmtEncoder struct {
+	buf []byte
+	ns  string // put in front of keys inside objects and namespaces
+}
+
+func (enc *logfmtEncoder) EncodeRecord(rec *LogRecord) string {
+	enc.buf = append(enc.buf[:0], "time="...)
+	enc.ns = ""
+	enc.buf = rec.Created.AppendFormat(enc.buf, time.RFC3339Nano)
+	enc.AddString("level", rec.Level.String())
+	if rec.Name != "" {
+		enc.AddString("logger", rec.Name)
+	}
+	if rec.Source != "" {
+		enc.AddString("source", rec.Source)
+	}
+	if rec.Func != "" {
+		enc.AddString("func", rec.Func)
+	}
+	enc.AddString("msg", rec.Message)
+	for _, f := range rec.Fields {
+		f.AddTo(enc)
+	}
+	enc.buf = append(enc.buf, '\n')
+	return string(enc.buf)
+}
+
+func (enc *logfmtEncoder) Clone() Encoder {
+	return &logfmtEncoder{}
+}
+
+// addKey starts a field, after the keys of the objects and namespaces it is
+// in.  Characters that would end the key are replaced.
+func (enc *logfmtEncoder) addKey(key string) {
+	if len(enc.buf) > 0 {
+		enc.buf = append(enc.buf, ' ')
+	}
+	if key == "" {
+		key = "_"
+	}
+	key = enc.ns + key
+	for _, r := range key {
+		if r <= ' ' || r == '=' || r == '"' || !unicode.IsPrint(r) {
+			r = '_'
+		}
+		enc.buf = append(enc.buf, string(r)...)
+	}
+	enc.buf = append(enc.buf, '=')
+}
+
+// addValue writes value, quoted if it is empty or holds spaces, quotes,
+// equals signs or characters that are not printable.
+func (enc *logfmtEncoder) addValue(value string) {
+	quote := value == ""
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || !unicode.IsPrint(r) {
+			quote = true
+			break
+		}
+	}
+	if quote {
+		enc.buf = strconv.AppendQuote(enc.buf, value)
+	} else {
+		enc.buf = append(enc.buf, value...)
+	}
+}
+
+func (enc *logfmtEncoder) AddBool(key string, value bool) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendBool(enc.buf, value)
+}
+
+func (enc *logfmtEncoder) AddInt(key string, value int) {
+	enc.AddInt64(key, int64(value))
+}
+
+func (enc *logfmtEncoder) AddInt32(key string, value int32) {
+	enc.AddInt64(key, int64(value))
+}
+
+func (enc *logfmtEncoder) AddUint32(key string, value uint32) {
+	enc.AddUint64(key, uint64(value))
+}
+
+func (enc *logfmtEncoder) AddInt64(key string, value int64) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendInt(enc.buf, value, 10)
+}
+
+func (enc *logfmtEncoder) AddUint64(key string, value uint64) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendUint(enc.buf, value, 10)
+}
+
+func (enc *logfmtEncoder) AddInt8(key string, value int8) {
+	enc.AddInt64(key, int64(value))
+}
+
+func (enc *logfmtEncoder) AddUint8(key string, value uint8) {
+	enc.AddUint64(key, uint64(value))
+}
+
+func (enc *logfmtEncoder) AddFloat32(key string, value float32) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendFloat(enc.buf, float64(value), 'f', -1, 32)
+}
+
+func (enc *logfmtEncoder) AddFloat64(key string, value float64) {
+	enc.addKey(key)
+	enc.buf = strconv.AppendFloat(enc.buf, value, 'f', -1, 64)
+}
+
+func (enc *logfmtEncoder) AddString(key, value string) {
+	enc.addKey(key)
+	enc.addValue(value)
+}
+
+func (enc *logfmtEncoder) AddInterface(key string, value interface{}) {
+	enc.addKey(key)
+	enc.addValue(reflectedText(value))
+}
+
+// AddStack writes the frames as one value, a frame to a line.
+func (enc *logfmtEncoder) AddStack(key string, frames []StackFrame) {
+	lines := make([]string, len(frames))
+	for i, frame := range frames {
+		lines[i] = frame.String()
+	}
+	enc.addKey(key)
+	enc.addValue(strings.Join(lines, "\n"))
+}
+
+func (enc *logfmtEncoder) AddDuration(key string, value time.Duration) {
+	enc.AddString(key, value.String())
+}
+
+func (enc *logfmtEncoder) AddTime(key string, value time.Time) {
+	enc.addKey(key)
+	enc.buf = value.AppendFormat(enc.buf, time.RFC3339Nano)
+}
+
+func (enc *logfmtEncoder) AddBinary(key string, value []byte) {
+	enc.AddString(key, base64.StdEncoding.EncodeToString(value))
+}
+
+// AddObject adds the fields of obj with their keys after key and a dot.
+func (enc *logfmtEncoder) AddObject(key string, obj ObjectMarshaler) error {
+	ns := enc.ns
+	enc.ns += key + "."
+	err := obj.MarshalLogObject(enc)
+	enc.ns = ns
+	return err
+}
+
+// AddArray adds arr as a JSON value.
+func (enc *logfmtEncoder) AddArray(key string, arr ArrayMarshaler) error {
+	value, err := jsonArray(arr)
+	enc.addKey(key)
+	enc.addValue(value)
+	return err
+}
+
+func (enc *logfmtEncoder) OpenNamespace(key string) {
+	enc.ns += key + "."
+}
@@ -0,0 +1,542 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// noLevel is stored as the cached minimum level of a Logger without filters,
+// so that no level is enabled.
+const noLevel = int32(CRITICAL) + 1
+
+// inheritLevel is stored as the level of a Logger that takes its level from
+// its parent (see GetLogger).
+const inheritLevel = int32(-1)
+
+// A loggerState holds what a Logger needs to be changed while other goroutines
+// are logging through it.  Logger stays a map so that code indexing it keeps
+// working: the filters are written into the map as well, under mu, but the
+// logging methods only ever read the state.
+type loggerState struct {
+	mu      sync.RWMutex
+	log     Logger    // the map this state belongs to; keeps its address in use
+	filters []*Filter // in dispatch order
+	names   []string  // parallel to filters
+	min     int32     // lowest filter level, accessed atomically
+	needs   int32     // whether any filter needs the caller, accessed atomically
+	epoch   int32     // callerEpoch when needs was worked out, accessed atomically
+	gone    bool      // whether log has been forgotten (see detach)
+
+	// Named loggers (see GetLogger)
+	name     string
+	parent   Logger // nil for the children of the root logger, Global
+	level    int32  // threshold for records logged here, accessed atomically
+	additive int32  // whether records go on to the parent, accessed atomically
+
+	stack    int32        // level from which stacks are added, accessed atomically
+	hooks    atomic.Value // []Hook
+	redactor atomic.Value // *Redactor
+	trim     atomic.Value // []string, prefixes trimmed from sources
+}
+
+func newLoggerState(log Logger) *loggerState {
+	return &loggerState{log: log, min: noLevel, level: inheritLevel, additive: 1, stack: inheritLevel}
+}
+
+// loggerStates maps the address of a Logger's map to its *loggerState.  A
+// Logger is only added once it has filters or settings, and an unnamed one
+// other than Global is removed again by Close unless it has settings to keep.
+var loggerStates sync.Map
+
+// key returns the address of the map behind log, which identifies it for as
+// long as its state holds on to it.
+func (log Logger) key() unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&log))
+}
+
+// A CallerNeeder is a LogWriter or Matcher that can tell whether it uses the
+// source or function of records.  Looking up the caller is slow, so the
+// logging methods skip it when no filter needs it; LogWriters and Matchers
+// that are not CallerNeeders are taken to need it.  The answer is checked when
+// the filter is added, and again after the format or encoder of a writer of
+// this package is changed.
+type CallerNeeder interface {
+	NeedsCaller() bool
+}
+
+// callerEpoch is bumped whenever a writer changes in a way that may change
+// whether it needs the caller, so that Loggers work it out again.
+var callerEpoch int32
+
+// callerChanged tells Loggers to work out again whether they need the caller.
+func callerChanged() {
+	atomic.AddInt32(&callerEpoch, 1)
+}
+
+// needsCaller reports whether v, a LogWriter or Matcher, needs the caller.
+func needsCaller(v interface{}) bool {
+	if cn, ok := v.(CallerNeeder); ok {
+		return cn.NeedsCaller()
+	}
+	return true
+}
+
+// formatNeedsCaller reports whether a FormatLogRecord format uses the caller.
+func formatNeedsCaller(format string) bool {
+	return strings.Contains(format, "%S") || strings.Contains(format, "%s") || strings.Contains(format, "%F")
+}
+
+// derivedKey is the key under which a Logger returned by With stores what it
+// derives from.  A derived Logger has no filters of its own.
+const derivedKey = "\x00derived"
+
+// A derivedLogger is stored under derivedKey in a Logger returned by With.
+// It is a LogWriter only so that it fits in a Filter: it passes records on to
+// base with its fields added.
+type derivedLogger struct {
+	base   Logger  // the Logger whose filters are shared
+	fields []Field // bound to every record
+	skip   int     // extra stack frames to skip to find the caller
+}
+
+func (d *derivedLogger) LogWrite(rec *LogRecord) {
+	dup := rec.clone()
+	dup.Fields = d.with(rec.Fields)
+	dup.Json = rec.Json || len(dup.Fields) > 0
+	s, _ := d.base.resolve()
+	s.dispatch(dup)
+	dup.Release()
+}
+
+// Close does nothing: the filters belong to the base Logger.
+func (d *derivedLogger) Close() {}
+
+// callerSkip returns the extra stack frames to skip to find the caller.
+func (d *derivedLogger) callerSkip() int {
+	if d == nil {
+		return 0
+	}
+	return d.skip
+}
+
+// with returns the bound fields followed by fields.
+func (d *derivedLogger) with(fields []Field) []Field {
+	if d == nil || len(d.fields) == 0 {
+		return fields
+	}
+	if len(fields) == 0 {
+		return d.fields
+	}
+	return append(d.fields[:len(d.fields):len(d.fields)], fields...)
+}
+
+// state returns the state whose filters log dispatches to, creating it from
+// the contents of the map if log has not been used through its methods
+// before, so that it can be changed.  It returns nil for a nil Logger.
+func (log Logger) state() *loggerState {
+	s, d := log.resolve()
+	if s == nil && log != nil {
+		if d != nil {
+			log = d.base
+		}
+		s = log.attach()
+	}
+	return s
+}
+
+// lockState returns the state of log, as state does, with its mu held for
+// writing.  The filters written straight into the map since the last change
+// are picked up first.
+func (log Logger) lockState() *loggerState {
+	for {
+		s := log.state()
+		s.mu.Lock()
+		if !s.gone {
+			s.adopt()
+			return s
+		}
+		// Close forgot the state; the next one is made from the map.
+		s.mu.Unlock()
+	}
+}
+
+// resolve returns the state whose filters log dispatches to and, if log was
+// returned by With, what it derives from.  A Logger without filters that has
+// never been changed through its methods has no state, so that logging
+// through a throwaway Logger does not keep it.
+func (log Logger) resolve() (*loggerState, *derivedLogger) {
+	if log == nil {
+		return nil, nil
+	}
+	if s, ok := loggerStates.Load(log.key()); ok {
+		return s.(*loggerState), nil
+	}
+
+	// A derived Logger is never changed after With returns it, so it is safe
+	// to read.
+	if filt, ok := log[derivedKey]; ok {
+		if d, ok := filt.LogWriter.(*derivedLogger); ok {
+			s, _ := d.base.resolve()
+			return s, d
+		}
+	}
+	if len(log) == 0 {
+		return nil, nil
+	}
+	return log.attach(), nil
+}
+
+// attachMu keeps the map of a Logger from being read to make its state while
+// the state that another goroutine made first is writing to it.
+var attachMu sync.Mutex
+
+// attach makes the state of log from the filters written straight into the
+// map, in name order.
+func (log Logger) attach() *loggerState {
+	attachMu.Lock()
+	defer attachMu.Unlock()
+	if s, ok := loggerStates.Load(log.key()); ok {
+		return s.(*loggerState)
+	}
+
+	s := newLoggerState(log)
+	s.adopt()
+	loggerStates.Store(log.key(), s)
+	return s
+}
+
+// adopt brings the filters of s in line with the map, so that filters stored
+// into it or deleted from it directly since the last change are picked up.
+// New names go after the others, in name order.  It must be called with s.mu
+// held for writing, or before s is stored.
+func (s *loggerState) adopt() {
+	changed := false
+	for i := 0; i < len(s.names); {
+		filt, ok := s.log[s.names[i]]
+		switch {
+		case !ok || filt == nil:
+			s.names = append(s.names[:i:i], s.names[i+1:]...)
+			s.filters = append(s.filters[:i:i], s.filters[i+1:]...)
+			changed = true
+			continue
+		case filt != s.filters[i]:
+			s.filters[i] = filt
+			changed = true
+		}
+		i++
+	}
+	if len(s.log) != len(s.names) {
+		var added []string
+		for name, filt := range s.log {
+			if filt != nil && s.index(name) < 0 {
+				added = append(added, name)
+			}
+		}
+		sort.Strings(added)
+		for _, name := range added {
+			s.names = append(s.names, name)
+			s.filters = append(s.filters, s.log[name])
+		}
+		changed = changed || len(added) > 0
+	}
+	if changed {
+		s.update()
+	}
+}
+
+// update recomputes the cached minimum level and whether any filter needs
+// the caller.  It must be called with s.mu held for writing.
+func (s *loggerState) update() {
+	epoch := atomic.LoadInt32(&callerEpoch)
+	min, caller := noLevel, int32(0)
+	for _, filt := range s.filters {
+		if lvl := int32(filt.Level); lvl < min {
+			min = lvl
+		}
+		if needsCaller(filt.LogWriter) || (filt.Matcher != nil && needsCaller(filt.Matcher)) {
+			caller = 1
+		}
+	}
+	atomic.StoreInt32(&s.min, min)
+	atomic.StoreInt32(&s.needs, caller)
+	atomic.StoreInt32(&s.epoch, epoch)
+}
+
+// parentState returns the state of the parent of a named logger, or nil.
+func (s *loggerState) parentState() *loggerState {
+	if s.name == "" {
+		return nil
+	}
+	if s.parent == nil {
+		return Global.state()
+	}
+	return s.parent.state()
+}
+
+// next is like parentState, but returns nil if additivity is off.
+func (s *loggerState) next() *loggerState {
+	if atomic.LoadInt32(&s.additive) == 0 {
+		return nil
+	}
+	return s.parentState()
+}
+
+// threshold returns the level below which records logged here are dropped,
+// which named loggers may inherit from their ancestors.
+func (s *loggerState) threshold() int32 {
+	for ; s != nil; s = s.parentState() {
+		if lvl := atomic.LoadInt32(&s.level); lvl != inheritLevel {
+			return lvl
+		}
+	}
+	return inheritLevel
+}
+
+// enabled reports whether any filter accepts records logged here at lvl.
+func (s *loggerState) enabled(lvl Level) bool {
+	if s == nil || int32(lvl) < s.threshold() {
+		return false
+	}
+	for ; s != nil; s = s.next() {
+		if int32(lvl) >= atomic.LoadInt32(&s.min) {
+			return true
+		}
+	}
+	return false
+}
+
+// caller returns the source and function of the caller skip frames above the
+// caller of caller, or nothing if neither a filter nor a hook of s or its
+// ancestors needs it.
+func (s *loggerState) caller(skip int) (src, fn string) {
+	need := false
+	for t := s; t != nil && !need; t = t.next() {
+		if atomic.LoadInt32(&t.epoch) != atomic.LoadInt32(&callerEpoch) {
+			t.mu.Lock()
+			t.update()
+			t.mu.Unlock()
+		}
+		need = atomic.LoadInt32(&t.needs) != 0
+	}
+	// Hooks may look at the source.
+	for t := s; t != nil && !need; t = t.parentState() {
+		hooks, _ := t.hooks.Load().([]Hook)
+		need = len(hooks) > 0
+	}
+	if !need {
+		return "", ""
+	}
+
+	pc, fileName, lineno, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "", ""
+	}
+	if f := runtime.FuncForPC(pc); f != nil {
+		fn = f.Name()
+	}
+	return fmt.Sprintf("%s:%d", s.trimFile(fileName), lineno), fn
+}
+
+// trimFile removes the first prefix set by SetCallerTrim that matches from
+// fileName.
+func (s *loggerState) trimFile(fileName string) string {
+	for ; s != nil; s = s.parentState() {
+		if prefixes, ok := s.trim.Load().([]string); ok {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(fileName, prefix) {
+					return fileName[len(prefix):]
+				}
+			}
+			return fileName
+		}
+	}
+	return fileName
+}
+
+// addStack adds the stack above the caller skip frames above the caller of
+// addStack to rec, if its level is at or above the stack level of s.
+func (s *loggerState) addStack(rec *LogRecord, skip int) {
+	lvl := inheritLevel
+	for t := s; t != nil && lvl == inheritLevel; t = t.parentState() {
+		lvl = atomic.LoadInt32(&t.stack)
+	}
+	if lvl == inheritLevel || int32(rec.Level) < lvl {
+		return
+	}
+	frames := stackFrames(skip + 1)
+	for i, frame := range frames {
+		frames[i].File = s.trimFile(frame.File)
+	}
+	rec.Fields = append(rec.Fields[:len(rec.Fields):len(rec.Fields)], Field{Key: "stacktrace", Type: StackType, Interface: frames})
+}
+
+// runHooks runs the hooks of s and then those of its ancestors on rec, and
+// reports whether rec should still be written.  If it should, the Redactors
+// of s and its ancestors are then run on it, so that they also see what the
+// hooks added.  A record the hooks add fields to is then structured, so that
+// the writers of text write them too.
+func (s *loggerState) runHooks(rec *LogRecord) bool {
+	// Appending to the fields must not write into the caller's slice.
+	n := len(rec.Fields)
+	rec.Fields = rec.Fields[:n:n]
+	t := s
+	for ; s != nil; s = s.parentState() {
+		hooks, _ := s.hooks.Load().([]Hook)
+		for _, hook := range hooks {
+			if !hook(rec) {
+				return false
+			}
+		}
+	}
+	if len(rec.Fields) > n {
+		rec.Json = true
+	}
+	for ; t != nil; t = t.parentState() {
+		if r, _ := t.redactor.Load().(*Redactor); r != nil {
+			r.Redact(rec)
+		}
+	}
+	return true
+}
+
+// dispatch sends rec to every filter that accepts its level, and then on to
+// the ancestors of a named logger while additivity allows.
+func (s *loggerState) dispatch(rec *LogRecord) {
+	for ; s != nil; s = s.next() {
+		s.write(rec)
+	}
+}
+
+// write sends rec to the filters of s that accept its level.  They all share
+// it, so none may change it.
+func (s *loggerState) write(rec *LogRecord) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, filt := range s.filters {
+		if rec.Level < filt.Level || (filt.Matcher != nil && !filt.Matcher.Match(rec)) {
+			continue
+		}
+		pass(filt.LogWriter, rec)
+	}
+}
+
+// pass writes rec to w, with a reference of its own if w is a RecordReleaser.
+// Otherwise w may keep rec, so it is never reused.
+func pass(w LogWriter, rec *LogRecord) {
+	if rr, ok := w.(RecordReleaser); ok && rr.ReleasesRecords() {
+		atomic.AddInt32(&rec.refs, 1)
+	} else {
+		atomic.StoreInt32(&rec.kept, 1)
+	}
+	w.LogWrite(rec)
+}
+
+// detach removes every filter from s and returns the names and filters in
+// dispatch order.  An unnamed Logger without settings to keep is forgotten,
+// as it may be garbage; it gets a new state if it is used again.
+func (s *loggerState) detach() ([]string, []*Filter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.gone {
+		s.adopt()
+	}
+	names, filters := s.names, s.filters
+	for _, name := range names {
+		delete(s.log, name)
+	}
+	s.filters, s.names = nil, nil
+	s.update()
+	if !s.gone && s.plain() && s.log.key() != Global.key() {
+		s.gone = true
+		loggerStates.Delete(s.log.key())
+	}
+	return names, filters
+}
+
+// plain reports whether s has nothing but filters: no name, level, hooks or
+// other settings.
+func (s *loggerState) plain() bool {
+	hooks, _ := s.hooks.Load().([]Hook)
+	r, _ := s.redactor.Load().(*Redactor)
+	return s.name == "" && len(hooks) == 0 && r == nil && s.trim.Load() == nil &&
+		atomic.LoadInt32(&s.level) == inheritLevel && atomic.LoadInt32(&s.stack) == inheritLevel &&
+		atomic.LoadInt32(&s.additive) == 1
+}
+
+// ancestorFilters returns the filters of the ancestors that the records of s
+// go on to, in dispatch order, and their names prefixed with the name of
+// their logger and a slash, as "db/file".  Global's are as "/file".
+func (s *loggerState) ancestorFilters() ([]string, []*Filter) {
+	var names []string
+	var filters []*Filter
+	for t := s.next(); t != nil; t = t.next() {
+		t.mu.RLock()
+		for i, name := range t.names {
+			names = append(names, t.name+"/"+name)
+			filters = append(filters, t.filters[i])
+		}
+		t.mu.RUnlock()
+	}
+	return names, filters
+}
+
+// levels returns the names and levels of the filters in dispatch order.
+func (s *loggerState) levels() ([]string, []Level) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lvls := make([]Level, len(s.filters))
+	for i, filt := range s.filters {
+		lvls[i] = filt.Level
+	}
+	return append([]string(nil), s.names...), lvls
+}
+
+// index returns the dispatch position of the named filter, or -1.  It must be
+// called with s.mu held.
+func (s *loggerState) index(name string) int {
+	for i, n := range s.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// set stores filt under name, keeping the position of a filter it replaces,
+// and returns the replaced filter, if any.  It must be called with s.mu held
+// for writing.
+func (s *loggerState) set(name string, filt *Filter) *Filter {
+	var old *Filter
+	if i := s.index(name); i >= 0 {
+		old = s.filters[i]
+		s.filters[i] = filt
+	} else {
+		s.names = append(s.names, name)
+		s.filters = append(s.filters, filt)
+	}
+	s.log[name] = filt
+	s.update()
+	return old
+}
+
+// remove deletes the named filter and returns it, if any.  It must be called
+// with s.mu held for writing.
+func (s *loggerState) remove(name string) *Filter {
+	i := s.index(name)
+	if i < 0 {
+		return nil
+	}
+	old := s.filters[i]
+	s.names = append(s.names[:i:i], s.names[i+1:]...)
+	s.filters = append(s.filters[:i:i], s.filters[i+1:]...)
+	delete(s.log, name)
+	s.update()
+	return old
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+// An ObjectMarshaler is a value that adds itself to an encoder as an object,
+// a field at a time.  Object fields and Any take them.
+type ObjectMarshaler interface {
+	MarshalLogObject(enc FieldEncoder) error
+}
+
+// ObjectMarshalerFunc adapts a function to an ObjectMarshaler.
+type ObjectMarshalerFunc func(enc FieldEncoder) error
+
+func (f ObjectMarshalerFunc) MarshalLogObject(enc FieldEncoder) error {
+	return f(enc)
+}
+
+// An ArrayMarshaler is a value that adds itself to an encoder as an array,
+// an element at a time.  Array fields and Any take them.
+type ArrayMarshaler interface {
+	MarshalLogArray(enc ArrayEncoder) error
+}
+
+// ArrayMarshalerFunc adapts a function to an ArrayMarshaler.
+type ArrayMarshalerFunc func(enc ArrayEncoder) error
+
+func (f ArrayMarshalerFunc) MarshalLogArray(enc ArrayEncoder) error {
+	return f(enc)
+}
+
+// An ArrayEncoder is what an ArrayMarshaler appends its elements to.
+type ArrayEncoder interface {
+	AppendBool(value bool)
+	AppendInt64(value int64)
+	AppendUint64(value uint64)
+	AppendFloat32(value float32)
+	AppendFloat64(value float64)
+	AppendString(value string)
+	// AppendInterface appends value as JSON, or as the text of it if it
+	// has no JSON form.
+	AppendInterface(value interface{})
+	AppendObject(obj ObjectMarshaler) error
+	AppendArray(arr ArrayMarshaler) error
+}
+
+// Object returns a field holding obj as a nested object.
+func Object(key string, obj ObjectMarshaler) Field {
+	return Field{Key: key, Type: ObjectType, Interface: obj}
+}
+
+// Array returns a field holding arr as an array.
+func Array(key string, arr ArrayMarshaler) Field {
+	return Field{Key: key, Type: ArrayType, Interface: arr}
+}
+
+// Namespace returns a field that puts the fields after it, up to the end of
+// the record or object, in an object named key.
+func Namespace(key string) Field {
+	return Field{Key: key, Type: NamespaceType}
+}
+
+func Bools(key string, values []bool) Field {
+	return Array(key, bools(values))
+}
+
+func Ints(key string, values []int) Field {
+	return Array(key, ints(values))
+}
+
+func Int32s(key string, values []int32) Field {
+	return Array(key, int32s(values))
+}
+
+func Int64s(key string, values []int64) Field {
+	return Array(key, int64s(values))
+}
+
+func Uint32s(key string, values []uint32) Field {
+	return Array(key, uint32s(values))
+}
+
+func Uint64s(key string, values []uint64) Field {
+	return Array(key, uint64s(values))
+}
+
+func Float32s(key string, values []float32) Field {
+	return Array(key, float32s(values))
+}
+
+func Float64s(key string, values []float64) Field {
+	return Array(key, float64s(values))
+}
+
+func Strings(key string, values []string) Field {
+	return Array(key, stringArray(values))
+}
+
+type bools []bool
+
+func (a bools) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendBool(v)
+	}
+	return nil
+}
+
+type ints []int
+
+func (a ints) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendInt64(int64(v))
+	}
+	return nil
+}
+
+type int32s []int32
+
+func (a int32s) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendInt64(int64(v))
+	}
+	return nil
+}
+
+type int64s []int64
+
+func (a int64s) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendInt64(v)
+	}
+	return nil
+}
+
+type uint32s []uint32
+
+func (a uint32s) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendUint64(uint64(v))
+	}
+	return nil
+}
+
+type uint64s []uint64
+
+func (a uint64s) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendUint64(v)
+	}
+	return nil
+}
+
+type float32s []float32
+
+func (a float32s) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendFloat32(v)
+	}
+	return nil
+}
+
+type float64s []float64
+
+func (a float64s) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendFloat64(v)
+	}
+	return nil
+}
+
+type stringArray []string
+
+func (a stringArray) MarshalLogArray(enc ArrayEncoder) error {
+	for _, v := range a {
+		enc.AppendString(v)
+	}
+	return nil
+}
+
+// copyArray returns arr with a copy of its slice if it was made by Bools,
+// Ints or the like, and arr itself otherwise.
+func copyArray(arr ArrayMarshaler) ArrayMarshaler {
+	switch a := arr.(type) {
+	case bools:
+		return append(bools(nil), a...)
+	case ints:
+		return append(ints(nil), a...)
+	case int32s:
+		return append(int32s(nil), a...)
+	case int64s:
+		return append(int64s(nil), a...)
+	case uint32s:
+		return append(uint32s(nil), a...)
+	case uint64s:
+		return append(uint64s(nil), a...)
+	case float32s:
+		return append(float32s(nil), a...)
+	case float64s:
+		return append(float64s(nil), a...)
+	case stringArray:
+		return append(stringArray(nil), a...)
+	}
+	return arr
+}
+
+// jsonArray returns arr as JSON, for encoders that write arrays as values of
+// their own.
+func jsonArray(arr ArrayMarshaler) (string, error) {
+	enc := getJsonEncoder()
+	defer putJsonEncoder(enc)
+	err := enc.appendArray(arr)
+	return string(enc.buf), err
+}
@@ -0,0 +1,172 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Matcher decides, beyond its level, whether a record is written to the
+// LogWriter of a Filter.  Matchers are called from many goroutines at once and
+// must neither change the record nor keep it.
+type Matcher interface {
+	Match(rec *LogRecord) bool
+}
+
+// MatcherFunc adapts an ordinary function to a Matcher.
+type MatcherFunc func(rec *LogRecord) bool
+
+func (f MatcherFunc) Match(rec *LogRecord) bool {
+	return f(rec)
+}
+
+// A recordMatcher is a Matcher that looks at neither the source nor the
+// function of records.
+type recordMatcher func(rec *LogRecord) bool
+
+func (f recordMatcher) Match(rec *LogRecord) bool {
+	return f(rec)
+}
+
+func (f recordMatcher) NeedsCaller() bool {
+	return false
+}
+
+// A matcherList is a Matcher made of others, which needs the caller if any of
+// them does.
+type matcherList struct {
+	match func(rec *LogRecord) bool
+	ms    []Matcher
+}
+
+func (l matcherList) Match(rec *LogRecord) bool {
+	return l.match(rec)
+}
+
+func (l matcherList) NeedsCaller() bool {
+	for _, m := range l.ms {
+		if needsCaller(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchLevelRange matches records from min up to and including max.
+func MatchLevelRange(min, max Level) Matcher {
+	return recordMatcher(func(rec *LogRecord) bool {
+		return rec.Level >= min && rec.Level <= max
+	})
+}
+
+// MatchLevels matches records at exactly one of lvls.
+func MatchLevels(lvls ...Level) Matcher {
+	var set [CRITICAL + 1]bool
+	for _, lvl := range lvls {
+		if lvl >= 0 && lvl <= CRITICAL {
+			set[lvl] = true
+		}
+	}
+	return recordMatcher(func(rec *LogRecord) bool {
+		return rec.Level >= 0 && rec.Level <= CRITICAL && set[rec.Level]
+	})
+}
+
+// MatchSource matches records whose Source matches re, such as
+// `/db/[^/]*\.go:` for the files of package db.  Filters with it make the
+// Logger look up the caller of every record.
+func MatchSource(re *regexp.Regexp) Matcher {
+	return MatcherFunc(func(rec *LogRecord) bool {
+		return re.MatchString(rec.Source)
+	})
+}
+
+// MatchMessage matches records whose Message contains substr.
+func MatchMessage(substr string) Matcher {
+	return recordMatcher(func(rec *LogRecord) bool {
+		return strings.Contains(rec.Message, substr)
+	})
+}
+
+// MatchField matches records with a field named key.
+func MatchField(key string) Matcher {
+	return recordMatcher(func(rec *LogRecord) bool {
+		for _, f := range rec.Fields {
+			if f.Key == key {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// MatchFieldValue matches records with a field named key whose value, as
+// text, is value.
+func MatchFieldValue(key, value string) Matcher {
+	return recordMatcher(func(rec *LogRecord) bool {
+		for _, f := range rec.Fields {
+			if f.Key == key && f.valueString() == value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// MatchAll matches records matched by all of ms.
+func MatchAll(ms ...Matcher) Matcher {
+	return matcherList{ms: ms, match: func(rec *LogRecord) bool {
+		for _, m := range ms {
+			if !m.Match(rec) {
+				return false
+			}
+		}
+		return true
+	}}
+}
+
+// MatchAny matches records matched by any of ms.
+func MatchAny(ms ...Matcher) Matcher {
+	return matcherList{ms: ms, match: func(rec *LogRecord) bool {
+		for _, m := range ms {
+			if m.Match(rec) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// MatchNot matches records not matched by m.
+func MatchNot(m Matcher) Matcher {
+	return matcherList{ms: []Matcher{m}, match: func(rec *LogRecord) bool {
+		return !m.Match(rec)
+	}}
+}
+
+// valueString returns the value of f as text.
+func (f Field) valueString() string {
+	switch f.Type {
+	case Int32Type, Int64Type, Int8Type, IntType:
+		return strconv.FormatInt(f.Integer, 10)
+	case Uint32Type, Uint64Type, Uint8Type:
+		return strconv.FormatUint(uint64(f.Integer), 10)
+	case StringType:
+		return f.String
+	case DurationType:
+		return time.Duration(f.Integer).String()
+	case TimeType:
+		return f.Interface.(time.Time).Format(time.RFC3339Nano)
+	case BinaryType:
+		return base64.StdEncoding.EncodeToString(f.Interface.([]byte))
+	case ErrorType:
+		return f.errorString()
+	default:
+		return fmt.Sprint(f.Interface)
+	}
+}
@@ -42,10 +42,33 @@ func getFormatCache() *formatCacheType {
 // %d - Date (01/02/06)
 // %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)
 // %S - Source
+// %F - Function
+// %N - Name of the logger (see GetLogger)
 // %M - Message
+// %C - Start of the colour of the level, on colour consoles
+// %c - End of the colour of the level, on colour consoles
 // Ignores unknown formats
 // Recommended: "[%D %T] [%L] (%S) %M"
 func FormatLogRecord(format string, rec *LogRecord) string {
+	if rec == nil {
+		return "<nil>"
+	}
+	return formatLogRecord(format, rec, rec.Message, nil)
+}
+
+// formatText is FormatLogRecord for writers of text, which write the fields of
+// structured records after the message.
+func formatText(format string, rec *LogRecord) string {
+	if !rec.Json {
+		return FormatLogRecord(format, rec)
+	}
+	return (&textEncoder{format: format}).EncodeRecord(rec)
+}
+
+// formatLogRecord is FormatLogRecord with msg in place of rec.Message, in the
+// colours of colors if it is not nil.  Formats without %C then have the level
+// coloured.
+func formatLogRecord(format string, rec *LogRecord, msg string, colors *ConsoleColors) string {
 	if rec == nil {
 		return "<nil>"
 	}
@@ -74,6 +97,7 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 
 	// Split the string into pieces by % signs
 	pieces := bytes.Split([]byte(format), []byte{'%'})
+	colorLevel := colors != nil && !strings.Contains(format, "%C")
 
 	// Iterate over the pieces, replacing known formats
 	for i, piece := range pieces {
@@ -88,14 +112,32 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 			case 'd':
 				out.WriteString(cache.shortDate)
 			case 'L':
-				out.WriteString(levelStrings[rec.Level])
+				if colorLevel {
+					out.WriteString(colors.start(rec.Level))
+					out.WriteString(levelStrings[rec.Level])
+					out.WriteString(colorReset)
+				} else {
+					out.WriteString(levelStrings[rec.Level])
+				}
+			case 'C':
+				if colors != nil {
+					out.WriteString(colors.start(rec.Level))
+				}
+			case 'c':
+				if colors != nil {
+					out.WriteString(colorReset)
+				}
 			case 'S':
 				out.WriteString(rec.Source)
 			case 's':
 				slice := strings.Split(rec.Source, "/")
 				out.WriteString(slice[len(slice)-1])
+			case 'F':
+				out.WriteString(rec.Func)
+			case 'N':
+				out.WriteString(rec.Name)
 			case 'M':
-				out.WriteString(rec.Message)
+				out.WriteString(msg)
 			}
 			if len(piece) > 1 {
 				out.Write(piece[1:])
@@ -106,33 +148,112 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 	}
 	out.WriteByte('\n')
 
+	// Stacks go on indented lines of their own
+	for _, f := range rec.Fields {
+		for _, frame := range f.frames() {
+			out.WriteByte('\t')
+			out.WriteString(frame.String())
+			out.WriteByte('\n')
+		}
+	}
+
 	return out.String()
 }
 
-// This is the standard writer that prints to standard output.
-type FormatLogWriter chan *LogRecord
+// This is the standard writer that prints to an io.Writer.
+type FormatLogWriter struct {
+	format  string
+	encoder Encoder // if set, used in place of format
+	queue   *recordQueue
+}
 
 // This creates a new FormatLogWriter
-func NewFormatLogWriter(out io.Writer, format string) FormatLogWriter {
-	records := make(FormatLogWriter, LogBufferLength)
-	go records.run(out, format)
-	return records
+func NewFormatLogWriter(out io.Writer, format string) *FormatLogWriter {
+	w := &FormatLogWriter{format: format, queue: newRecordQueue()}
+	go w.run(out)
+	return w
+}
+
+// Set the encoder of records, in place of the format and of the fields of
+// structured records following the message (chainable).  Must be called
+// before the first log message is written.
+func (w *FormatLogWriter) SetEncoder(enc Encoder) *FormatLogWriter {
+	w.encoder = enc.Clone()
+	callerChanged()
+	return w
+}
+
+// NeedsCaller reports whether the format or encoder uses the source or
+// function.
+func (w *FormatLogWriter) NeedsCaller() bool {
+	return encoderNeedsCaller(w.encoder, w.format)
 }
 
-func (w FormatLogWriter) run(out io.Writer, format string) {
-	for rec := range w {
-		fmt.Fprint(out, FormatLogRecord(format, rec))
+func (w *FormatLogWriter) run(out io.Writer) {
+	var err error
+	for {
+		rec, ok := w.queue.pop()
+		if !ok {
+			return
+		}
+		if rec.flush != nil {
+			rec.flush <- err
+			err = nil
+			continue
+		}
+		var text string
+		if w.encoder != nil {
+			text = w.encoder.EncodeRecord(rec)
+		} else {
+			text = formatText(w.format, rec)
+		}
+		rec.Release()
+		if _, werr := fmt.Fprint(out, text); werr != nil && err == nil {
+			err = werr
+		}
 	}
 }
 
-// This is the FormatLogWriter's output method.  This will block if the output
-// buffer is full.
-func (w FormatLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+// This is the FormatLogWriter's output method.  What it does when the output
+// buffer is full depends on its Overflow; by default it blocks.
+func (w *FormatLogWriter) LogWrite(rec *LogRecord) {
+	w.queue.push(rec)
+}
+
+// ReleasesRecords reports that the writer releases the records passed to it.
+func (w *FormatLogWriter) ReleasesRecords() bool {
+	return true
+}
+
+// Flush waits until the records passed to the writer so far have been
+// written, and returns the first error writing them since the last Flush.
+func (w *FormatLogWriter) Flush() error {
+	return w.queue.flush()
+}
+
+// Set the size of the output buffer (chainable).  Must be called before the
+// first log message is written.
+func (w *FormatLogWriter) SetBufferSize(size int) *FormatLogWriter {
+	w.queue.resize(size)
+	return w
+}
+
+// Set what LogWrite does when the output buffer is full (chainable).
+func (w *FormatLogWriter) SetOverflow(o Overflow) *FormatLogWriter {
+	w.queue.setOverflow(o)
+	return w
+}
+
+// Dropped returns how many records have been dropped because the output
+// buffer was full.
+func (w *FormatLogWriter) Dropped() uint64 {
+	return w.queue.dropCount()
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
-func (w FormatLogWriter) Close() {
-	close(w)
+// Close stops the logger from sending messages to the io.Writer, once the
+// messages already sent are written.  Attempts to send log messages to this
+// logger after a Close have undefined behavior.
+func (w *FormatLogWriter) Close() {
+	w.Flush()
+	w.queue.close()
 }
@@ -0,0 +1,242 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An OverflowPolicy says what the LogWrite of a LogWriter that writes from a
+// goroutine of its own does when its buffer is full.
+type OverflowPolicy int
+
+const (
+	// BlockOnFull waits for room in the buffer.
+	BlockOnFull OverflowPolicy = iota
+	// TimeoutOnFull waits up to the Timeout of the Overflow, and then drops
+	// the record.
+	TimeoutOnFull
+	// DropNewestOnFull drops the record being written.
+	DropNewestOnFull
+	// DropOldestOnFull drops the oldest record in the buffer to make room,
+	// or the record being written if the buffer has no room at all.
+	DropOldestOnFull
+	// DropBelowOnFull drops the record being written if it is below the Level
+	// of the Overflow, and waits for room otherwise.
+	DropBelowOnFull
+)
+
+var overflowPolicyNames = []string{"block", "timeout", "drop-newest", "drop-oldest", "drop-below"}
+
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(overflowPolicyNames) {
+		return "unknown"
+	}
+	return overflowPolicyNames[p]
+}
+
+// An Overflow configures what a LogWriter does when its buffer is full.
+type Overflow struct {
+	Policy  OverflowPolicy
+	Timeout time.Duration // how long TimeoutOnFull waits
+	Level   Level         // the lowest level DropBelowOnFull keeps
+}
+
+// A recordQueue is the buffer between the LogWrite of a LogWriter and the
+// goroutine that writes its records.  The goroutine releases the records it
+// pops once it has written them.
+type recordQueue struct {
+	ch       chan *LogRecord // where records are sent
+	in       chan *LogRecord // where the goroutine receives; only it changes in
+	overflow atomic.Value    // Overflow
+	dropped  uint64          // accessed atomically
+
+	// Markers DropOldestOnFull takes off the front of the buffer, which the
+	// goroutine takes before the records in the buffer.
+	mu     sync.Mutex
+	front  []*LogRecord
+	fronts int32         // len(front), accessed atomically
+	ready  chan struct{} // signalled when a marker is added to front
+
+	// closeMu keeps flush from sending on the buffer once close has closed it.
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// errQueueClosed is what flush returns once the queue is closed.
+var errQueueClosed = errors.New("log4go: flush of a closed writer")
+
+func newRecordQueue() *recordQueue {
+	ch := make(chan *LogRecord, LogBufferLength)
+	q := &recordQueue{ch: ch, in: ch, ready: make(chan struct{}, 1)}
+	q.overflow.Store(Overflow{})
+	return q
+}
+
+// resize replaces the buffer with one that holds size records.  It must be
+// called before the first record is pushed.
+func (q *recordQueue) resize(size int) {
+	ch := make(chan *LogRecord, size)
+	q.ch <- &LogRecord{next: ch}
+	q.ch = ch
+}
+
+// switched reports whether rec tells the goroutine to receive from a new
+// buffer, and if so switches to it.
+func (q *recordQueue) switched(rec *LogRecord) bool {
+	if rec.next == nil {
+		return false
+	}
+	q.in = rec.next
+	return true
+}
+
+// pop returns the next record for the goroutine, or false once the queue is
+// closed and empty.
+func (q *recordQueue) pop() (*LogRecord, bool) {
+	for {
+		rec := q.popFront()
+		if rec == nil {
+			var ok bool
+			select {
+			case rec, ok = <-q.in:
+				if !ok {
+					if rec = q.popFront(); rec == nil {
+						return nil, false
+					}
+				}
+			case <-q.ready:
+				continue
+			}
+		}
+		if !q.switched(rec) {
+			return rec, true
+		}
+	}
+}
+
+// pushFront puts a marker taken off the front of the buffer back in front of
+// it.
+func (q *recordQueue) pushFront(rec *LogRecord) {
+	q.mu.Lock()
+	q.front = append(q.front, rec)
+	atomic.StoreInt32(&q.fronts, int32(len(q.front)))
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// popFront returns the first marker put back by pushFront, or nil.
+func (q *recordQueue) popFront() *LogRecord {
+	if atomic.LoadInt32(&q.fronts) == 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.front) == 0 {
+		return nil
+	}
+	rec := q.front[0]
+	q.front = q.front[1:]
+	atomic.StoreInt32(&q.fronts, int32(len(q.front)))
+	return rec
+}
+
+// push adds rec to the queue, or drops it as the Overflow says.
+func (q *recordQueue) push(rec *LogRecord) {
+	select {
+	case q.ch <- rec:
+		return
+	default:
+	}
+
+	o := q.overflow.Load().(Overflow)
+	switch o.Policy {
+	case TimeoutOnFull:
+		timer := time.NewTimer(o.Timeout)
+		defer timer.Stop()
+		select {
+		case q.ch <- rec:
+		case <-timer.C:
+			q.drop(rec)
+		}
+	case DropNewestOnFull:
+		q.drop(rec)
+	case DropOldestOnFull:
+		if cap(q.ch) == 0 {
+			// There is no buffer to drop from.
+			q.drop(rec)
+			return
+		}
+		for {
+			select {
+			case q.ch <- rec:
+				return
+			default:
+			}
+			select {
+			case old := <-q.ch:
+				if old.flush != nil || old.next != nil {
+					// Markers are never dropped, and keep their place.
+					q.pushFront(old)
+				} else {
+					q.drop(old)
+				}
+			default:
+			}
+		}
+	case DropBelowOnFull:
+		if rec.Level < o.Level {
+			q.drop(rec)
+			return
+		}
+		q.ch <- rec
+	default:
+		q.ch <- rec
+	}
+}
+
+// drop counts and releases a record that is not written.
+func (q *recordQueue) drop(rec *LogRecord) {
+	atomic.AddUint64(&q.dropped, 1)
+	rec.Release()
+}
+
+// flush waits until the goroutine reaches the records pushed so far, and
+// returns what it answers, or errQueueClosed if the queue is closed.
+func (q *recordQueue) flush() error {
+	q.closeMu.RLock()
+	if q.closed {
+		q.closeMu.RUnlock()
+		return errQueueClosed
+	}
+	rec := newFlushRecord()
+	q.ch <- rec
+	q.closeMu.RUnlock()
+	return <-rec.flush
+}
+
+// close tells the goroutine to return once the queue is empty.  Closing it
+// again does nothing.
+func (q *recordQueue) close() {
+	q.closeMu.Lock()
+	defer q.closeMu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+func (q *recordQueue) setOverflow(o Overflow) {
+	q.overflow.Store(o)
+}
+
+// dropCount returns how many records have been dropped so far.
+func (q *recordQueue) dropCount() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
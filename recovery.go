@@ -0,0 +1,185 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An ErrorHandler is called with the errors LogWriters hit while writing
+// from goroutines of their own, such as failing to write, rotate or dial.  It
+// is called from those goroutines, so it must not block for long or log to
+// the writer that failed.
+type ErrorHandler func(w LogWriter, err error)
+
+var errorHandler atomic.Value // ErrorHandler
+
+// SetErrorHandler sets the handler for the errors of LogWriters.  A nil
+// handler restores the default, which prints them to standard error.
+func SetErrorHandler(h ErrorHandler) {
+	if h == nil {
+		h = stderrErrorHandler
+	}
+	errorHandler.Store(h)
+}
+
+func stderrErrorHandler(w LogWriter, err error) {
+	fmt.Fprintf(os.Stderr, "%s\n", err)
+}
+
+func handleError(w LogWriter, err error) {
+	h, _ := errorHandler.Load().(ErrorHandler)
+	if h == nil {
+		h = stderrErrorHandler
+	}
+	h(w, err)
+}
+
+// A RecoveryPolicy says what a LogWriter does with a record it failed to
+// write.
+type RecoveryPolicy int
+
+const (
+	// DropOnError drops the record.  The next record is tried as usual.
+	DropOnError RecoveryPolicy = iota
+	// RetryOnError tries the record again after a backoff, and drops it when
+	// it runs out of retries.
+	RetryOnError
+	// StderrOnError writes the record to standard error instead.
+	StderrOnError
+)
+
+var recoveryPolicyNames = []string{"drop", "retry", "stderr"}
+
+func (p RecoveryPolicy) String() string {
+	if p < 0 || int(p) >= len(recoveryPolicyNames) {
+		return "unknown"
+	}
+	return recoveryPolicyNames[p]
+}
+
+// A Recovery configures how a LogWriter recovers from errors.  Records that
+// are retried hold up the records behind them.
+type Recovery struct {
+	Policy     RecoveryPolicy
+	Retries    int           // tries after the first, for RetryOnError
+	Backoff    time.Duration // wait before the first retry, doubled after each
+	MaxBackoff time.Duration // longest wait between retries, if not 0
+}
+
+// DefaultRecovery is the Recovery of new LogWriters.
+var DefaultRecovery = Recovery{
+	Policy:     DropOnError,
+	Retries:    3,
+	Backoff:    10 * time.Millisecond,
+	MaxBackoff: time.Second,
+}
+
+// A Health is the state of a LogWriter's output.
+type Health struct {
+	Healthy   bool      // whether the last record was written
+	LastError error     // the last error, even if the writer recovered since
+	Failures  uint64    // records that could not be written
+	Since     time.Time // when Healthy last changed, or the writer was created
+}
+
+// A HealthReporter is a LogWriter that reports the state of its output.
+type HealthReporter interface {
+	Health() Health
+}
+
+// writerHealth tracks the Health of a LogWriter and carries out its Recovery.
+type writerHealth struct {
+	mu       sync.Mutex
+	health   Health
+	recovery Recovery
+	unsynced error // first record lost since the last flush
+}
+
+func newWriterHealth() *writerHealth {
+	return &writerHealth{
+		health:   Health{Healthy: true, Since: time.Now()},
+		recovery: DefaultRecovery,
+	}
+}
+
+// Health returns the current Health.
+func (h *writerHealth) Health() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health
+}
+
+func (h *writerHealth) setRecovery(r Recovery) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recovery = r
+}
+
+func (h *writerHealth) getRecovery() Recovery {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.recovery
+}
+
+// write calls try until it succeeds or the Recovery gives up on the record,
+// reporting every error to the ErrorHandler as coming from w.  If the record
+// is given up on, text is written to standard error under StderrOnError.
+func (h *writerHealth) write(w LogWriter, text string, try func() error) {
+	r := h.getRecovery()
+	err := try()
+	backoff := r.Backoff
+	for retry := 0; err != nil && r.Policy == RetryOnError && retry < r.Retries; retry++ {
+		handleError(w, err)
+		time.Sleep(backoff)
+		if backoff *= 2; r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+		err = try()
+	}
+
+	if err != nil {
+		handleError(w, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		if !h.health.Healthy {
+			h.health.Healthy, h.health.Since = true, time.Now()
+		}
+		return
+	}
+	if h.health.Healthy {
+		h.health.Healthy, h.health.Since = false, time.Now()
+	}
+	h.health.LastError = err
+	h.health.Failures++
+	if h.unsynced == nil {
+		h.unsynced = err
+	}
+	if r.Policy == StderrOnError {
+		fmt.Fprint(os.Stderr, text)
+	}
+}
+
+// flushed returns the error of the first record lost since the last call.
+func (h *writerHealth) flushed() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.unsynced
+	h.unsynced = nil
+	return err
+}
+
+// writerHealthOf returns the Health of w, if it is a HealthReporter.
+func writerHealthOf(w LogWriter) (Health, bool) {
+	if hr, ok := w.(HealthReporter); ok {
+		return hr.Health(), true
+	}
+	return Health{}, false
+}
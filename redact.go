@@ -0,0 +1,374 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A RedactMode is how a Redactor hides the values of the fields it matches.
+type RedactMode int
+
+const (
+	// RedactMask replaces the value with the placeholder of the Redactor.
+	RedactMask RedactMode = iota
+	// RedactHash replaces the value with "sha256:" and the first 16 hex
+	// digits of its SHA-256, so equal values can still be told apart.
+	RedactHash
+	// RedactTruncate keeps the first runes of the value, followed by "...".
+	RedactTruncate
+)
+
+var redactModeNames = []string{"mask", "hash", "truncate"}
+
+func (m RedactMode) String() string {
+	if m < 0 || int(m) >= len(redactModeNames) {
+		return "unknown"
+	}
+	return redactModeNames[m]
+}
+
+// DefaultRedactPlaceholder is what RedactMask writes in place of values.
+const DefaultRedactPlaceholder = "[REDACTED]"
+
+// Patterns of the messages rules a Redactor adds with RedactCards,
+// RedactEmails and RedactIPs.  IPPattern takes IPv6 addresses shortened with
+// "::" only if they keep at least two groups, so that text such as
+// "std::string" is left alone.
+var (
+	CardNumberPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	EmailPattern      = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	IPPattern         = regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b|(?i:\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b|\b[0-9a-f]{1,4}(?::[0-9a-f]{1,4}){0,5}::[0-9a-f]{1,4}(?::[0-9a-f]{1,4}){0,5}\b|\b[0-9a-f]{1,4}(?::[0-9a-f]{1,4}){1,6}::\B|\B::[0-9a-f]{1,4}(?::[0-9a-f]{1,4}){1,6}\b)`)
+)
+
+// A Redactor hides secrets and personal data in records before any writer
+// encodes them.  Key rules match the keys of fields, also inside objects,
+// arrays and values written as JSON, and hide their values.  Message rules
+// replace the text their regexps match in messages.
+//
+// Rules are added with the chainable methods below, which must not be called
+// once the Redactor is set on a Logger.
+type Redactor struct {
+	placeholder string
+	keep        int
+	keys        []redactKeyRule
+	messages    []redactMessageRule
+}
+
+type redactKeyRule struct {
+	glob *regexp.Regexp
+	mode RedactMode
+}
+
+type redactMessageRule struct {
+	re          *regexp.Regexp
+	replacement string
+	check       func(match string) bool // if set, only matches it accepts are replaced
+}
+
+// NewRedactor returns a Redactor without rules, which masks values with
+// DefaultRedactPlaceholder and keeps 4 runes of those it truncates.
+func NewRedactor() *Redactor {
+	return &Redactor{placeholder: DefaultRedactPlaceholder, keep: 4}
+}
+
+// Set what RedactMask writes in place of values (chainable).
+func (r *Redactor) SetPlaceholder(placeholder string) *Redactor {
+	r.placeholder = placeholder
+	return r
+}
+
+// Set how many runes RedactTruncate keeps (chainable).
+func (r *Redactor) SetKeep(keep int) *Redactor {
+	r.keep = keep
+	return r
+}
+
+// Hide the values of fields whose keys match any of globs (chainable).  In a
+// glob, * matches any text and ? any one character; case is ignored.
+func (r *Redactor) RedactKeys(mode RedactMode, globs ...string) *Redactor {
+	for _, glob := range globs {
+		pattern := regexp.QuoteMeta(glob)
+		pattern = strings.Replace(pattern, `\*`, ".*", -1)
+		pattern = strings.Replace(pattern, `\?`, ".", -1)
+		r.keys = append(r.keys, redactKeyRule{regexp.MustCompile("(?is)^" + pattern + "$"), mode})
+	}
+	return r
+}
+
+// Replace the text re matches in messages with replacement, which may refer
+// to submatches as in regexp.Regexp.ReplaceAllString (chainable).
+func (r *Redactor) RedactMessage(re *regexp.Regexp, replacement string) *Redactor {
+	r.messages = append(r.messages, redactMessageRule{re: re, replacement: replacement})
+	return r
+}
+
+// Replace card numbers in messages with "[CARD]" (chainable).  Only numbers
+// that pass the Luhn check are replaced.
+func (r *Redactor) RedactCards() *Redactor {
+	r.messages = append(r.messages, redactMessageRule{re: CardNumberPattern, replacement: "[CARD]", check: luhnValid})
+	return r
+}
+
+// Replace email addresses in messages with "[EMAIL]" (chainable).
+func (r *Redactor) RedactEmails() *Redactor {
+	return r.RedactMessage(EmailPattern, "[EMAIL]")
+}
+
+// Replace IPv4 and IPv6 addresses in messages with "[IP]" (chainable).
+func (r *Redactor) RedactIPs() *Redactor {
+	return r.RedactMessage(IPPattern, "[IP]")
+}
+
+// Redact hides what the rules of r match in rec.  The fields of rec are
+// replaced, not written to, as they may be shared.
+func (r *Redactor) Redact(rec *LogRecord) {
+	rec.Message = r.redactMessage(rec.Message)
+	fields, copied := rec.Fields, false
+	for i, f := range rec.Fields {
+		redacted, changed := r.redactField(f)
+		if !changed {
+			continue
+		}
+		if !copied {
+			fields, copied = append([]Field(nil), rec.Fields...), true
+		}
+		fields[i] = redacted
+	}
+	rec.Fields = fields
+}
+
+func (r *Redactor) redactMessage(msg string) string {
+	for _, rule := range r.messages {
+		if rule.check == nil {
+			msg = rule.re.ReplaceAllString(msg, rule.replacement)
+			continue
+		}
+		msg = rule.re.ReplaceAllStringFunc(msg, func(match string) string {
+			if !rule.check(match) {
+				return match
+			}
+			return rule.replacement
+		})
+	}
+	return msg
+}
+
+// keyRule returns the first rule that matches key, or nil.
+func (r *Redactor) keyRule(key string) *redactKeyRule {
+	for i := range r.keys {
+		if r.keys[i].glob.MatchString(key) {
+			return &r.keys[i]
+		}
+	}
+	return nil
+}
+
+// hide returns what mode writes in place of value.
+func (r *Redactor) hide(mode RedactMode, value string) string {
+	switch mode {
+	case RedactHash:
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	case RedactTruncate:
+		runes := []rune(value)
+		if len(runes) <= r.keep {
+			return value
+		}
+		return string(runes[:r.keep]) + "..."
+	}
+	return r.placeholder
+}
+
+// redactField returns f with its value hidden if its key matches a rule, or
+// wrapped so that the keys inside it are checked as it is encoded, and
+// whether f was changed.
+func (r *Redactor) redactField(f Field) (Field, bool) {
+	switch f.Type {
+	case UnknownType, NamespaceType, StackType:
+		return f, false
+	}
+	if rule := r.keyRule(f.Key); rule != nil {
+		return String(f.Key, r.hide(rule.mode, f.valueString())), true
+	}
+	if len(r.keys) == 0 {
+		return f, false
+	}
+	switch f.Type {
+	case ObjectType:
+		return Object(f.Key, redactedObject{f.Interface.(ObjectMarshaler), r}), true
+	case ArrayType:
+		return Array(f.Key, redactedArray{f.Interface.(ArrayMarshaler), r}), true
+	case InterfaceType:
+		if value, changed := r.redactValue(f.Interface); changed {
+			return Field{Key: f.Key, Type: InterfaceType, Interface: value}, true
+		}
+	}
+	return f, false
+}
+
+// redactValue returns value, written as JSON, with the members whose keys
+// match a rule hidden, and whether any were.
+func (r *Redactor) redactValue(value interface{}) (interface{}, bool) {
+	text, err := json.Marshal(value)
+	if err != nil {
+		return value, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(text))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return value, false
+	}
+	if !r.redactGeneric(generic) {
+		return value, false
+	}
+	return generic, true
+}
+
+// redactGeneric hides the members of the objects in v, as decoded from JSON,
+// whose keys match a rule, and reports whether it hid any.
+func (r *Redactor) redactGeneric(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, member := range v {
+			if rule := r.keyRule(key); rule != nil {
+				text, ok := member.(string)
+				if !ok {
+					b, _ := json.Marshal(member)
+					text = string(b)
+				}
+				v[key], changed = r.hide(rule.mode, text), true
+			} else if r.redactGeneric(member) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if r.redactGeneric(elem) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// A redactedObject checks the keys an ObjectMarshaler adds as it is encoded.
+type redactedObject struct {
+	obj ObjectMarshaler
+	r   *Redactor
+}
+
+func (o redactedObject) MarshalLogObject(enc FieldEncoder) error {
+	return o.obj.MarshalLogObject(redactingEncoder{enc, o.r})
+}
+
+// A redactedArray checks the keys of the objects an ArrayMarshaler appends as
+// it is encoded.
+type redactedArray struct {
+	arr ArrayMarshaler
+	r   *Redactor
+}
+
+func (a redactedArray) MarshalLogArray(enc ArrayEncoder) error {
+	return a.arr.MarshalLogArray(redactingArrayEncoder{enc, a.r})
+}
+
+// A redactingEncoder passes the fields added to it through a Redactor.
+type redactingEncoder struct {
+	enc FieldEncoder
+	r   *Redactor
+}
+
+func (e redactingEncoder) add(f Field) {
+	f, _ = e.r.redactField(f)
+	f.AddTo(e.enc)
+}
+
+func (e redactingEncoder) AddBool(key string, value bool)              { e.add(Bool(key, value)) }
+func (e redactingEncoder) AddInt(key string, value int)                { e.add(Int(key, value)) }
+func (e redactingEncoder) AddInt32(key string, value int32)            { e.add(Int32(key, value)) }
+func (e redactingEncoder) AddUint32(key string, value uint32)          { e.add(Uint32(key, value)) }
+func (e redactingEncoder) AddInt64(key string, value int64)            { e.add(Int64(key, value)) }
+func (e redactingEncoder) AddUint64(key string, value uint64)          { e.add(Uint64(key, value)) }
+func (e redactingEncoder) AddInt8(key string, value int8)              { e.add(Int8(key, value)) }
+func (e redactingEncoder) AddUint8(key string, value uint8)            { e.add(Uint8(key, value)) }
+func (e redactingEncoder) AddFloat32(key string, value float32)        { e.add(Float32(key, value)) }
+func (e redactingEncoder) AddFloat64(key string, value float64)        { e.add(Float64(key, value)) }
+func (e redactingEncoder) AddString(key, value string)                 { e.add(String(key, value)) }
+func (e redactingEncoder) AddDuration(key string, value time.Duration) { e.add(Duration(key, value)) }
+func (e redactingEncoder) AddTime(key string, value time.Time)         { e.add(Time(key, value)) }
+func (e redactingEncoder) AddBinary(key string, value []byte)          { e.add(Binary(key, value)) }
+func (e redactingEncoder) OpenNamespace(key string)                    { e.enc.OpenNamespace(key) }
+
+func (e redactingEncoder) AddInterface(key string, value interface{}) {
+	e.add(Field{Key: key, Type: InterfaceType, Interface: value})
+}
+
+func (e redactingEncoder) AddStack(key string, frames []StackFrame) {
+	e.enc.AddStack(key, frames)
+}
+
+func (e redactingEncoder) AddObject(key string, obj ObjectMarshaler) error {
+	if rule := e.r.keyRule(key); rule != nil {
+		e.enc.AddString(key, e.r.hide(rule.mode, fmt.Sprint(obj)))
+		return nil
+	}
+	return e.enc.AddObject(key, redactedObject{obj, e.r})
+}
+
+func (e redactingEncoder) AddArray(key string, arr ArrayMarshaler) error {
+	if rule := e.r.keyRule(key); rule != nil {
+		e.enc.AddString(key, e.r.hide(rule.mode, fmt.Sprint(arr)))
+		return nil
+	}
+	return e.enc.AddArray(key, redactedArray{arr, e.r})
+}
+
+// A redactingArrayEncoder passes the objects and values appended to it
+// through a Redactor.
+type redactingArrayEncoder struct {
+	ArrayEncoder
+	r *Redactor
+}
+
+func (e redactingArrayEncoder) AppendInterface(value interface{}) {
+	value, _ = e.r.redactValue(value)
+	e.ArrayEncoder.AppendInterface(value)
+}
+
+func (e redactingArrayEncoder) AppendObject(obj ObjectMarshaler) error {
+	return e.ArrayEncoder.AppendObject(redactedObject{obj, e.r})
+}
+
+func (e redactingArrayEncoder) AppendArray(arr ArrayMarshaler) error {
+	return e.ArrayEncoder.AppendArray(redactedArray{arr, e.r})
+}
+
+// luhnValid reports whether the digits of number pass the Luhn check.
+func luhnValid(number string) bool {
+	sum, double := 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// This log writer caps how many records with the same level and message are
+// passed on to another LogWriter.
+type SamplingLogWriter struct {
+	LogWriter
+
+	tick       time.Duration
+	first      int
+	thereafter int
+
+	mu      sync.Mutex
+	reset   time.Time
+	counts  map[sampleKey]*sampleCount
+	dropped uint64
+}
+
+type sampleKey struct {
+	lvl Level
+	msg string
+}
+
+type sampleCount struct {
+	seen    int // records seen this tick
+	dropped int // records dropped since the last one let through
+}
+
+// NewSamplingLogWriter creates a new LogWriter which, for each tick, passes on
+// the first records with the same level and message to w, and after that only
+// every thereafter-th one (or none, if thereafter is 0).  The first record let
+// through after some were dropped says how many.
+func NewSamplingLogWriter(w LogWriter, tick time.Duration, first, thereafter int) *SamplingLogWriter {
+	return &SamplingLogWriter{
+		LogWriter:  w,
+		tick:       tick,
+		first:      first,
+		thereafter: thereafter,
+		counts:     make(map[sampleKey]*sampleCount),
+	}
+}
+
+// This is the SamplingLogWriter's output method
+func (s *SamplingLogWriter) LogWrite(rec *LogRecord) {
+	s.mu.Lock()
+	now := time.Now()
+	if !now.Before(s.reset) {
+		s.newTick(now)
+	}
+	key := sampleKey{rec.Level, rec.Message}
+	c := s.counts[key]
+	if c == nil {
+		c = &sampleCount{}
+		s.counts[key] = c
+	}
+	c.seen++
+	if c.seen > s.first && (s.thereafter <= 0 || (c.seen-s.first)%s.thereafter != 0) {
+		c.dropped++
+		s.dropped++
+		s.mu.Unlock()
+		return
+	}
+	dropped := c.dropped
+	c.dropped = 0
+	s.mu.Unlock()
+
+	if dropped > 0 {
+		dup := withDropped(rec, dropped)
+		pass(s.LogWriter, dup)
+		dup.Release()
+		return
+	}
+	s.LogWriter.LogWrite(rec)
+}
+
+// newTick starts counting again.  Keys with records dropped but not reported
+// yet are kept, so the count still reaches the next record let through.  It
+// must be called with s.mu held.
+func (s *SamplingLogWriter) newTick(now time.Time) {
+	counts := make(map[sampleKey]*sampleCount)
+	for key, c := range s.counts {
+		if c.dropped > 0 {
+			counts[key] = &sampleCount{dropped: c.dropped}
+		}
+	}
+	s.counts = counts
+	s.reset = now.Add(s.tick)
+}
+
+// Flush flushes the underlying LogWriter if it is a Flusher.
+func (s *SamplingLogWriter) Flush() error {
+	return flushWriter(s.LogWriter)
+}
+
+// Health reports the Health of the underlying LogWriter, which is healthy if
+// it is not a HealthReporter.
+func (s *SamplingLogWriter) Health() Health {
+	if h, ok := writerHealthOf(s.LogWriter); ok {
+		return h
+	}
+	return Health{Healthy: true}
+}
+
+// Dropped returns how many records have been dropped so far.
+func (s *SamplingLogWriter) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// withDropped returns a pooled copy of rec that reports n dropped records: as a
+// field of structured records, or at the end of the message of others.  The
+// record itself may be shared with other filters, so it is not changed.
+func withDropped(rec *LogRecord, n int) *LogRecord {
+	dup := rec.clone()
+	if dup.Json {
+		dup.Fields = append(dup.Fields[:len(dup.Fields):len(dup.Fields)], Int("dropped", n))
+	} else {
+		dup.Message = fmt.Sprintf("%s (%d similar records dropped)", dup.Message, n)
+	}
+	return dup
+}
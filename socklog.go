@@ -3,53 +3,166 @@
 package log4go
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
-	"os"
+	"time"
 )
 
+// SocketDialTimeout limits how long a SocketLogWriter waits to connect.
+var SocketDialTimeout = 5 * time.Second
+
+// maxRedialBackoff is the longest a SocketLogWriter waits to dial again if
+// the MaxBackoff of its Recovery is 0.
+const maxRedialBackoff = time.Minute
+
 // This log writer sends output to a socket
-type SocketLogWriter chan *LogRecord
+type SocketLogWriter struct {
+	queue   *recordQueue
+	health  *writerHealth
+	encoder Encoder // NewJSONEncoder unless set
+}
 
-// This is the SocketLogWriter's output method
-func (w SocketLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+// This is the SocketLogWriter's output method.  What it does when the output
+// buffer is full depends on its Overflow; by default it blocks.
+func (w *SocketLogWriter) LogWrite(rec *LogRecord) {
+	w.queue.push(rec)
 }
 
-func (w SocketLogWriter) Close() {
-	close(w)
+// Flush waits until the records passed to the writer so far have been sent.
+// If any record was lost since the last Flush, it returns the error.
+func (w *SocketLogWriter) Flush() error {
+	return w.queue.flush()
 }
 
-func NewSocketLogWriter(proto, hostport string) SocketLogWriter {
-	sock, err := net.Dial(proto, hostport)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewSocketLogWriter(%q): %s\n", hostport, err)
-		return nil
+// ReleasesRecords reports that the writer releases the records passed to it.
+func (w *SocketLogWriter) ReleasesRecords() bool {
+	return true
+}
+
+// Health reports the state of the connection.
+func (w *SocketLogWriter) Health() Health {
+	return w.health.Health()
+}
+
+// Set how the writer recovers from errors dialing and sending (chainable).
+func (w *SocketLogWriter) SetRecovery(r Recovery) *SocketLogWriter {
+	w.health.setRecovery(r)
+	return w
+}
+
+// Set the size of the output buffer (chainable).  Must be called before the
+// first log message is written.
+func (w *SocketLogWriter) SetBufferSize(size int) *SocketLogWriter {
+	w.queue.resize(size)
+	return w
+}
+
+// Set what LogWrite does when the output buffer is full (chainable).
+func (w *SocketLogWriter) SetOverflow(o Overflow) *SocketLogWriter {
+	w.queue.setOverflow(o)
+	return w
+}
+
+// Dropped returns how many records have been dropped because the output
+// buffer was full.
+func (w *SocketLogWriter) Dropped() uint64 {
+	return w.queue.dropCount()
+}
+
+// Set the encoder of records, in place of that of NewJSONEncoder (chainable).
+// Must be called before the first log message is written.
+func (w *SocketLogWriter) SetEncoder(enc Encoder) *SocketLogWriter {
+	w.encoder = enc.Clone()
+	return w
+}
+
+// Close stops the writer, once the records already passed to it are sent.
+func (w *SocketLogWriter) Close() {
+	w.Flush()
+	w.queue.close()
+}
+
+// NewSocketLogWriter creates a new LogWriter which sends records to hostport as
+// JSON, a line each, as NewJSONEncoder writes them.  If it cannot connect, or
+// the connection fails later, it dials again for a later record, once the
+// Backoff of its Recovery has passed; the wait is doubled after each failure
+// to connect in a row, up to MaxBackoff, or a minute if that is 0.  Records
+// written while it waits fail at once, and are dropped or written to standard
+// error as the Recovery says.
+func NewSocketLogWriter(proto, hostport string) *SocketLogWriter {
+	w := &SocketLogWriter{
+		queue:   newRecordQueue(),
+		health:  newWriterHealth(),
+		encoder: newJsonEncoder(),
+	}
+
+	var redial time.Time // when to dial again
+	var failures int     // failures to connect in a row
+	dial := func() (net.Conn, error) {
+		if now := time.Now(); now.Before(redial) {
+			return nil, fmt.Errorf("not connected, dialing again in %v", redial.Sub(now))
+		}
+		sock, err := net.DialTimeout(proto, hostport, SocketDialTimeout)
+		if err != nil {
+			r := w.health.getRecovery()
+			max := r.MaxBackoff
+			if max == 0 {
+				max = maxRedialBackoff
+			}
+			failures++
+			backoff := r.Backoff
+			for i := 1; i < failures && backoff > 0 && backoff < max; i++ {
+				backoff *= 2
+			}
+			if backoff > max {
+				backoff = max
+			}
+			redial = time.Now().Add(backoff)
+			return nil, err
+		}
+		failures = 0
+		return sock, nil
 	}
 
-	w := SocketLogWriter(make(chan *LogRecord, LogBufferLength))
+	sock, err := dial()
+	if err != nil {
+		handleError(w, fmt.Errorf("NewSocketLogWriter(%q): %w", hostport, err))
+	}
 
 	go func() {
 		defer func() {
-			if sock != nil && proto == "tcp" {
+			if sock != nil {
 				sock.Close()
 			}
 		}()
 
-		for rec := range w {
-			// Marshall into JSON
-			js, err := json.Marshal(rec)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
+		for {
+			rec, ok := w.queue.pop()
+			if !ok {
 				return
 			}
-
-			_, err = sock.Write(js)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
+			if rec.flush != nil {
+				rec.flush <- w.health.flushed()
+				continue
 			}
+
+			text := w.encoder.EncodeRecord(rec)
+			rec.Release()
+
+			w.health.write(w, text, func() error {
+				var err error
+				if sock == nil {
+					if sock, err = dial(); err != nil {
+						return fmt.Errorf("SocketLogWriter(%q): %w", hostport, err)
+					}
+				}
+				if _, err := sock.Write([]byte(text)); err != nil {
+					sock.Close()
+					sock = nil
+					return fmt.Errorf("SocketLogWriter(%q): %w", hostport, err)
+				}
+				return nil
+			})
 		}
 	}()
 
@@ -6,49 +6,270 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"time"
 )
 
 var stdout io.Writer = os.Stdout
+var stderr io.Writer = os.Stderr
+
+// A ColorMode says whether a ConsoleLogWriter writes in colour.
+type ColorMode int
+
+const (
+	// ColorAuto writes in colour if FORCE_COLOR is set to anything but 0 or
+	// false, and otherwise if NO_COLOR is not set and the output is a
+	// terminal whose TERM is not dumb.
+	ColorAuto ColorMode = iota
+	// ColorAlways always writes in colour.
+	ColorAlways
+	// ColorNever never writes in colour.
+	ColorNever
+)
+
+var colorModeNames = []string{"auto", "always", "never"}
+
+func (m ColorMode) String() string {
+	if m < 0 || int(m) >= len(colorModeNames) {
+		return "unknown"
+	}
+	return colorModeNames[m]
+}
+
+// ConsoleColors are the colours of a ConsoleLogWriter, as the parameters of
+// ANSI SGR escape sequences, such as "31" for red or "1;33" for bold yellow.
+type ConsoleColors struct {
+	Levels [len(levelStrings)]string // indexed by Level
+	Key    string                    // keys of fields, not coloured if empty
+	Value  string                    // values of fields, not coloured if empty
+}
+
+// DefaultConsoleColors are the colours of new ConsoleLogWriters.
+var DefaultConsoleColors = ConsoleColors{
+	Levels: [...]string{"90", "90", "36", "34", "32", "33", "31", "1;31"},
+	Key:    "36",
+	Value:  "35",
+}
+
+const colorReset = "\x1b[0m"
+
+// sgr returns the escape sequence that starts the colour params.
+func sgr(params string) string {
+	return "\x1b[" + params + "m"
+}
+
+// start returns the escape sequence that starts the colour of lvl.
+func (cc *ConsoleColors) start(lvl Level) string {
+	if lvl < 0 || int(lvl) >= len(cc.Levels) || cc.Levels[lvl] == "" {
+		return colorReset
+	}
+	return sgr(cc.Levels[lvl])
+}
+
+// useColor reports whether mode writes to out in colour.
+func useColor(mode ColorMode, out io.Writer) bool {
+	switch mode {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if force, ok := os.LookupEnv("FORCE_COLOR"); ok {
+		return force != "0" && force != "false"
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(out)
+}
+
+// isTerminal reports whether out is a terminal.
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
 // This is the standard writer that prints to standard output.
 type ConsoleLogWriter struct {
-	format string
-	w      chan *LogRecord
+	format  string
+	encoder Encoder // if set, used in place of format
+	color   ColorMode
+	colors  ConsoleColors
+	out     io.Writer // where records below level go
+	high    io.Writer // if set, where records at or above level go
+	level   Level
+	queue   *recordQueue
+	done    chan struct{} // closed when run returns
 }
 
 // This creates a new ConsoleLogWriter
 func NewConsoleLogWriter() *ConsoleLogWriter {
 	consoleWriter := &ConsoleLogWriter{
 		format: "[%T %D] [%L] (%S) %M",
-		w:      make(chan *LogRecord, LogBufferLength),
+		colors: DefaultConsoleColors,
+		out:    stdout,
+		queue:  newRecordQueue(),
+		done:   make(chan struct{}),
 	}
-	go consoleWriter.run(stdout)
+	go consoleWriter.run()
 	return consoleWriter
 }
 func (c *ConsoleLogWriter) SetFormat(format string) {
 	c.format = format
+	callerChanged()
 }
-func (c *ConsoleLogWriter) run(out io.Writer) {
-	for rec := range c.w {
-		fmt.Fprint(out, FormatLogRecord(c.format, rec))
+
+// Set the encoder of records, in place of the format and of the fields of
+// structured records following the message (chainable).  Must be called
+// before the first log message is written.
+func (c *ConsoleLogWriter) SetEncoder(enc Encoder) *ConsoleLogWriter {
+	c.encoder = enc.Clone()
+	callerChanged()
+	return c
+}
+
+// Set whether the writer writes in colour (chainable).  In colour, the level
+// is coloured, or the text between %C and %c if the format has them, and so
+// are the keys and values of fields.  Encoders other than NewTextEncoder are
+// never coloured.  Must be called before the first log message is written.
+func (c *ConsoleLogWriter) SetColor(mode ColorMode) *ConsoleLogWriter {
+	c.color = mode
+	return c
+}
+
+// Set the colours used when writing in colour (chainable).  Must be called
+// before the first log message is written.
+func (c *ConsoleLogWriter) SetColors(colors ConsoleColors) *ConsoleLogWriter {
+	c.colors = colors
+	return c
+}
+
+// Write records at or above lvl to standard error, and the others to standard
+// output (chainable).  Must be called before the first log message is
+// written.
+func (c *ConsoleLogWriter) SetStderrLevel(lvl Level) *ConsoleLogWriter {
+	return c.SetOutputs(stdout, stderr, lvl)
+}
+
+// Write records at or above lvl to high, and the others to low (chainable).
+// A nil high writes every record to low.  Records are written one at a time,
+// so the lines of each stream keep their order.  Must be called before the
+// first log message is written.
+func (c *ConsoleLogWriter) SetOutputs(low, high io.Writer, lvl Level) *ConsoleLogWriter {
+	c.out, c.high, c.level = low, high, lvl
+	return c
+}
+
+// NeedsCaller reports whether the format or encoder uses the source or
+// function.
+func (c *ConsoleLogWriter) NeedsCaller() bool {
+	return encoderNeedsCaller(c.encoder, c.format)
+}
+
+// colorEncoder returns the encoder of the writer in colour, or nil if it does
+// not write to out in colour.
+func (c *ConsoleLogWriter) colorEncoder(out io.Writer) Encoder {
+	if !useColor(c.color, out) {
+		return nil
+	}
+	switch enc := c.encoder.(type) {
+	case nil:
+		return &textEncoder{format: c.format, colors: &c.colors}
+	case *textEncoder:
+		return &textEncoder{format: enc.format, colors: &c.colors}
 	}
+	return nil
 }
 
-// This is the ConsoleLogWriter's output method.  This will block if the output
-// buffer is full.
-func (c *ConsoleLogWriter) LogWrite(rec *LogRecord) {
-	if rec.Json {
-		encode := getJsonEncoder()
-		rec.Message = encode.EncodeString(rec)
-		putJsonEncoder(encode)
+// A consoleStream is an output of a ConsoleLogWriter.
+type consoleStream struct {
+	out     io.Writer
+	colored Encoder // the encoder in colour, if out is written in colour
+}
+
+func (c *ConsoleLogWriter) run() {
+	defer close(c.done)
+	var err error
+	var low, high consoleStream
+	first := true
+	for {
+		rec, ok := c.queue.pop()
+		if !ok {
+			return
+		}
+		if rec.flush != nil {
+			rec.flush <- err
+			err = nil
+			continue
+		}
+		if first {
+			low = consoleStream{c.out, c.colorEncoder(c.out)}
+			if c.high != nil {
+				high = consoleStream{c.high, c.colorEncoder(c.high)}
+			}
+			first = false
+		}
+		stream := &low
+		if high.out != nil && rec.Level >= c.level {
+			stream = &high
+		}
+		var text string
+		if stream.colored != nil {
+			text = stream.colored.EncodeRecord(rec)
+		} else if c.encoder != nil {
+			text = c.encoder.EncodeRecord(rec)
+		} else {
+			text = formatText(c.format, rec)
+		}
+		rec.Release()
+		if _, werr := fmt.Fprint(stream.out, text); werr != nil && err == nil {
+			err = werr
+		}
 	}
-	c.w <- rec
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
+// This is the ConsoleLogWriter's output method.  What it does when the output
+// buffer is full depends on its Overflow; by default it blocks.
+func (c *ConsoleLogWriter) LogWrite(rec *LogRecord) {
+	c.queue.push(rec)
+}
+
+// ReleasesRecords reports that the writer releases the records passed to it.
+func (c *ConsoleLogWriter) ReleasesRecords() bool {
+	return true
+}
+
+// Flush waits until the records passed to the writer so far have been
+// written, and returns the first error writing them since the last Flush.
+func (c *ConsoleLogWriter) Flush() error {
+	return c.queue.flush()
+}
+
+// Set the size of the output buffer (chainable).  Must be called before the
+// first log message is written.
+func (c *ConsoleLogWriter) SetBufferSize(size int) *ConsoleLogWriter {
+	c.queue.resize(size)
+	return c
+}
+
+// Set what LogWrite does when the output buffer is full (chainable).
+func (c *ConsoleLogWriter) SetOverflow(o Overflow) *ConsoleLogWriter {
+	c.queue.setOverflow(o)
+	return c
+}
+
+// Dropped returns how many records have been dropped because the output
+// buffer was full.
+func (c *ConsoleLogWriter) Dropped() uint64 {
+	return c.queue.dropCount()
+}
+
+// Close stops the logger from sending messages to its outputs, once the
+// messages already sent are written.  Attempts to send log messages to this
+// logger after a Close have undefined behavior.
 func (c *ConsoleLogWriter) Close() {
-	close(c.w)
-	time.Sleep(50 * time.Millisecond) // Try to give console I/O time to complete
+	c.queue.close()
+	<-c.done
 }
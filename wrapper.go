@@ -3,6 +3,7 @@
 package log4go
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -26,11 +27,26 @@ func AddFilter(name string, lvl Level, writer LogWriter) {
 	Global.AddFilter(name, lvl, writer)
 }
 
+// Wrapper for (*Logger).With
+func With(fields ...Field) Logger {
+	return Global.With(fields...)
+}
+
 // Wrapper for (*Logger).Close (closes and removes all logwriters)
 func Close() {
 	Global.Close()
 }
 
+// Wrapper for (*Logger).Flush
+func Flush() error {
+	return Global.Flush()
+}
+
+// Wrapper for (*Logger).Shutdown
+func Shutdown(ctx context.Context) error {
+	return Global.Shutdown(ctx)
+}
+
 func Crash(args ...interface{}) {
 	if len(args) > 0 {
 		Global.intLogf(CRITICAL, strings.Repeat(" %v", len(args))[1:], args...)
@@ -182,6 +198,23 @@ func Criticalf(arg0 string, args ...interface{}) {
 	Global.intLogf(lvl, arg0, args...)
 }
 
+// Wrapper for (*Logger).Finest
+func Finest(message string, field ...Field) {
+	const (
+		lvl = FINEST
+	)
+	Global.intLogJson(lvl, message, field...)
+}
+
+// Wrapper for (*Logger).Fine
+func Fine(message string, field ...Field) {
+	const (
+		lvl = FINE
+	)
+	Global.intLogJson(lvl, message, field...)
+}
+
+// Wrapper for (*Logger).Debug
 func Debug(message string, field ...Field) {
 	const (
 		lvl = DEBUG
@@ -189,6 +222,15 @@ func Debug(message string, field ...Field) {
 	Global.intLogJson(lvl, message, field...)
 }
 
+// Wrapper for (*Logger).Trace
+func Trace(message string, field ...Field) {
+	const (
+		lvl = TRACE
+	)
+	Global.intLogJson(lvl, message, field...)
+}
+
+// Wrapper for (*Logger).Info
 func Info(message string, field ...Field) {
 	const (
 		lvl = INFO
@@ -196,6 +238,7 @@ func Info(message string, field ...Field) {
 	Global.intLogJson(lvl, message, field...)
 }
 
+// Wrapper for (*Logger).Warn
 func Warn(message string, field ...Field) {
 	const (
 		lvl = WARNING
@@ -203,9 +246,69 @@ func Warn(message string, field ...Field) {
 	Global.intLogJson(lvl, message, field...)
 }
 
+// Wrapper for (*Logger).Error
 func Error(message string, field ...Field) {
 	const (
 		lvl = ERROR
 	)
 	Global.intLogJson(lvl, message, field...)
 }
+
+// Wrapper for (*Logger).Critical
+func Critical(message string, field ...Field) {
+	const (
+		lvl = CRITICAL
+	)
+	Global.intLogJson(lvl, message, field...)
+}
+
+// Wrapper for (*Logger).Fatal
+func Fatal(message string, field ...Field) {
+	const (
+		lvl = CRITICAL
+	)
+	Global.intLogJson(lvl, message, field...)
+	Global.exit()
+}
+
+// Wrapper for (*Logger).Panic
+func Panic(message string, field ...Field) {
+	const (
+		lvl = CRITICAL
+	)
+	Global.intLogJson(lvl, message, field...)
+	Global.Flush() // so that the messages get logged
+	panic(message)
+}
+
+// Wrapper for (*Logger).DebugCtx
+func DebugCtx(ctx context.Context, message string, field ...Field) {
+	const (
+		lvl = DEBUG
+	)
+	Global.intLogCtx(ctx, lvl, message, field...)
+}
+
+// Wrapper for (*Logger).InfoCtx
+func InfoCtx(ctx context.Context, message string, field ...Field) {
+	const (
+		lvl = INFO
+	)
+	Global.intLogCtx(ctx, lvl, message, field...)
+}
+
+// Wrapper for (*Logger).WarnCtx
+func WarnCtx(ctx context.Context, message string, field ...Field) {
+	const (
+		lvl = WARNING
+	)
+	Global.intLogCtx(ctx, lvl, message, field...)
+}
+
+// Wrapper for (*Logger).ErrorCtx
+func ErrorCtx(ctx context.Context, message string, field ...Field) {
+	const (
+		lvl = ERROR
+	)
+	Global.intLogCtx(ctx, lvl, message, field...)
+}